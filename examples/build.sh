@@ -6,6 +6,7 @@ export CGO_ENABLED=0
 
 poco bundle --local --image firefox:latest --output firefox \
                 --entrypoint /usr/bin/firefox \
+                --app-profile gui \
                 --app-mounts /sys \
                 --app-mounts /tmp \
                 --app-mounts /run
\ No newline at end of file
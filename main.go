@@ -18,16 +18,18 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
 
-	"github.com/mholt/archiver/v3"
-	"github.com/mudler/luet/pkg/api/core/image"
+	"github.com/docker/go-units"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/mudler/poco/internal"
 	"github.com/mudler/poco/pkg/bundler"
+	"github.com/mudler/poco/pkg/desktop"
 	"github.com/mudler/poco/pkg/extractor"
 	"github.com/otiai10/copy"
 	"github.com/pterm/pterm"
@@ -36,7 +38,7 @@ import (
 
 func common() []cli.Flag {
 
-	return []cli.Flag{
+	return append([]cli.Flag{
 		&cli.StringFlag{
 			Name:   "entrypoint",
 			EnvVar: "ENTRYPOINT",
@@ -49,11 +51,35 @@ func common() []cli.Flag {
 			EnvVar: "OUTPUT",
 			Value:  "sample",
 		},
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:   "directory",
-			Usage:  "Directory to pack",
+			Usage:  "Directory to pack. Can be specified multiple times, directories are layered in order on top of the images",
 			EnvVar: "DIRECTORY",
-			Value:  "",
+		},
+		&cli.StringSliceFlag{
+			Name:   "add",
+			Usage:  "Add a file or directory to the bundle as src:/path/in/image, on top of the images and directories. Can be specified multiple times",
+			EnvVar: "ADD",
+		},
+		&cli.StringSliceFlag{
+			Name:   "exclude",
+			Usage:  "Drop the files matching a glob (e.g. /usr/share/man, *.a) or a preset (" + strings.Join(bundler.PresetNames(), ", ") + ") from the bundle. Can be specified multiple times",
+			EnvVar: "EXCLUDE",
+		},
+		&cli.StringSliceFlag{
+			Name:   "include",
+			Usage:  "Keep the files matching a glob, even if excluded. Can be specified multiple times",
+			EnvVar: "INCLUDE",
+		},
+		&cli.BoolFlag{
+			Name:   "minimize",
+			Usage:  "Bundle only the entrypoint, the app commands, the --keep paths and the libraries they load from the image",
+			EnvVar: "MINIMIZE",
+		},
+		&cli.StringSliceFlag{
+			Name:   "keep",
+			Usage:  "A path (or glob) of the image kept by --minimize, along with its content and the libraries it needs. Can be specified multiple times",
+			EnvVar: "KEEP",
 		},
 		&cli.StringFlag{
 			Name:   "app-description",
@@ -101,16 +127,81 @@ func common() []cli.Flag {
 			EnvVar: "ATTRS",
 			Value:  &cli.StringSlice{"ipc", "uts", "user", "ns", "pid"},
 		},
+		&cli.StringFlag{
+			Name:   "app-desktop-file",
+			Usage:  "Desktop entry installed by the bundle 'install-desktop' command. By default it is looked up in the image /usr/share/applications",
+			EnvVar: "DESKTOP_FILE",
+		},
+		&cli.StringFlag{
+			Name:   "app-icon",
+			Usage:  "Icon (png or svg) installed by the bundle 'install-desktop' command. By default the desktop entry icon is looked up in the image",
+			EnvVar: "ICON",
+		},
+		&cli.StringFlag{
+			Name:   "app-hostname",
+			Usage:  "Hostname of the app, set if the uts attr is enabled. Defaults to the app name",
+			EnvVar: "APP_HOSTNAME",
+		},
+		&cli.StringFlag{
+			Name:   "app-cwd",
+			Usage:  "Share by default the current directory with the app and start it there, at the same path (host) or at an absolute path (e.g. /work). Useful for CLI tools",
+			EnvVar: "CWD",
+		},
+		&cli.StringSliceFlag{
+			Name:   "app-profile",
+			Usage:  "Define a list of default profiles sharing host resources with the app. Supported: gui (X11, Wayland, PulseAudio, PipeWire, D-Bus and fonts)",
+			EnvVar: "PROFILES",
+		},
+		&cli.BoolTFlag{
+			Name:   "app-strict",
+			EnvVar: "STRICT",
+			Usage:  "Abort the bundle execution if the sandbox setup fails (e.g. a non-optional mount or the pivot root). Use --app-strict=false to only print setup failures",
+		},
+		&cli.StringSliceFlag{
+			Name:   "app-command",
+			Usage:  "Define a command bundled in the app as name=/path/in/image. The app runs it when invoked as name (e.g. with a symlink) or with name as first argument",
+			EnvVar: "COMMANDS",
+		},
 		&cli.StringSliceFlag{
 			Name:   "app-store",
 			Usage:  "Define a default application store where the bundle content will be uncompressed. It defaults to a temporary directory otherwise. (e.g. $HOME/.app/foo)",
 			EnvVar: "STORE",
 		},
-		&cli.StringFlag{
-			Usage:  "Image to be used as bundle content",
+		&cli.StringSliceFlag{
+			Usage:  "Image to be used as bundle content. Can be specified multiple times, images are layered in order. Defaults to alpine, unless --directory is given",
 			Name:   "image",
 			EnvVar: "IMAGE",
-			Value:  "alpine",
+			Value:  &cli.StringSlice{"alpine"},
+		},
+		&cli.StringFlag{
+			Name:   "platform",
+			EnvVar: "PLATFORM",
+			Usage:  "Platform of the image, as os/arch[/variant] (e.g. linux/arm64). Defaults to linux on the architecture targeted by the Go build ($GOARCH)",
+		},
+		&cli.StringFlag{
+			Name:   "lock-file",
+			EnvVar: "LOCK_FILE",
+			Usage:  "Lock file pinning the registry images to their digests (e.g. poco.lock). Images are not locked if empty",
+		},
+		&cli.StringFlag{
+			Name:   "cache-dir",
+			Usage:  "Directory caching the image layers pulled from registries, empty to disable the cache",
+			EnvVar: "POCO_CACHE_DIR",
+			Value:  bundler.DefaultCacheDir(),
+		},
+		&cli.BoolFlag{
+			Name:   "update-lock",
+			EnvVar: "UPDATE_LOCK",
+			Usage:  "Update the lock file when the images resolve to new digests, in place of failing",
+		},
+		&cli.StringFlag{
+			Name:   "verify-key",
+			EnvVar: "VERIFY_KEY",
+			Usage:  "Verify the images signatures with a cosign public key before unpacking them. Signatures are fetched from the image registry",
+		},
+		&cli.StringSliceFlag{
+			Name:  "signature",
+			Usage: "Signature file of an image, verified with --verify-key in place of fetching it from the registry. Can be specified multiple times",
 		},
 		&cli.StringFlag{
 			Name:   "command-prefix",
@@ -118,6 +209,46 @@ func common() []cli.Flag {
 			Value:  "sudo",
 			Usage:  "Prefix go generate commands with sudo. This is required if not running bundler as root and want to preserve container permissions",
 		},
+	}, registryFlags()...)
+}
+
+// registryFlags are the flags setting how to reach the registries and the credentials to use
+func registryFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:   "registry-username",
+			EnvVar: "REGISTRY_USERNAME",
+			Usage:  "Username to authenticate to the registry of the image with, it is not sent to other registries or mirrors. By default the credentials are read from $REGISTRY_AUTH_FILE and the docker config ($DOCKER_CONFIG or ~/.docker/config.json)",
+		},
+		&cli.BoolFlag{
+			Name:  "registry-password-stdin",
+			Usage: "Read the password (or token) of --registry-username from stdin",
+		},
+		&cli.StringFlag{
+			Name:  "registry-auth-file",
+			Usage: "Read the registry credentials from a docker config.json formatted file",
+		},
+		&cli.StringFlag{
+			Name:   "config",
+			EnvVar: "POCO_CONFIG",
+			Usage:  "poco config file. Defaults to $XDG_CONFIG_HOME/poco/config.yaml (~/.config/poco/config.yaml)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "insecure-registry",
+			Usage: "Registry to reach over plain HTTP, or without verifying its certificate. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "registry-mirror",
+			Usage: "Pull the images of a registry from a mirror, as registry=mirror (e.g. docker.io=mirror.example.com). Can be specified multiple times",
+		},
+		&cli.StringFlag{
+			Name:  "ca-file",
+			Usage: "PEM bundle of certificate authorities to trust when connecting to the registries, along with the system ones",
+		},
+		&cli.StringFlag{
+			Name:  "registry-proxy",
+			Usage: "Proxy URL used to connect to the registries. Defaults to $HTTPS_PROXY, $HTTP_PROXY and $NO_PROXY",
+		},
 	}
 }
 
@@ -125,13 +256,189 @@ func pocoVersion() string {
 	return fmt.Sprintf("%s-g%s", internal.Version, internal.Commit)
 }
 
+// reservedCommands can't be used as app commands, as they are
+// the bundle builtin commands or the name used to re-execute itself
+var reservedCommands = []string{"exec", "ps", "enter", "uninstall", "install-links", "install-desktop", "uninstall-desktop", "help", "h", "exe"}
+
+func parseAppCommands(commands []string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, c := range commands {
+		dat := strings.SplitN(c, "=", 2)
+		if len(dat) != 2 || dat[0] == "" || !path.IsAbs(dat[1]) {
+			return nil, fmt.Errorf("invalid app command '%s', it must be in the form name=/path/in/image", c)
+		}
+		if strings.Contains(dat[0], "/") {
+			return nil, fmt.Errorf("invalid app command name '%s'", dat[0])
+		}
+		if contains(reservedCommands, dat[0]) {
+			return nil, fmt.Errorf("app command name '%s' is reserved", dat[0])
+		}
+		res[dat[0]] = dat[1]
+	}
+	return res, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// absPath returns the absolute path of p, as the generated code is built from another directory
+func absPath(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		pterm.Fatal.Println(err)
+	}
+	return abs
+}
+
+// loadConfig reads the poco config file, if any, and applies the flags on top of it
+func loadConfig(c *cli.Context) *bundler.Config {
+	file := c.String("config")
+	if file == "" {
+		dir, err := os.UserConfigDir()
+		if err == nil {
+			file = filepath.Join(dir, "poco", "config.yaml")
+		}
+		if _, err := os.Stat(file); err != nil {
+			file = ""
+		}
+	}
+
+	config := &bundler.Config{}
+	if file != "" {
+		var err error
+		config, err = bundler.LoadConfig(file)
+		if err != nil {
+			pterm.Fatal.Println(err)
+		}
+	}
+
+	r := &config.Registries
+	r.Insecure = append(r.Insecure, c.StringSlice("insecure-registry")...)
+	for _, m := range c.StringSlice("registry-mirror") {
+		from, to, err := bundler.ParseMirror(m)
+		if err != nil {
+			pterm.Fatal.Println(err)
+		}
+		if r.Mirrors == nil {
+			r.Mirrors = map[string]string{}
+		}
+		r.Mirrors[from] = to
+	}
+	if ca := c.String("ca-file"); ca != "" {
+		r.CAFile = ca
+	}
+	r.CAFile = absPath(r.CAFile)
+	if proxy := c.String("registry-proxy"); proxy != "" {
+		r.Proxy = proxy
+	}
+	return config
+}
+
+func absPaths(paths []string) []string {
+	var res []string
+	for _, p := range paths {
+		res = append(res, absPath(p))
+	}
+	return res
+}
+
+func cliFilter(c *cli.Context) bundler.Filter {
+	return bundler.Filter{Exclude: c.StringSlice("exclude"), Include: c.StringSlice("include")}
+}
+
+// cliImageConfig returns the config of the images created by pack
+func cliImageConfig(c *cli.Context) (bundler.ImageConfig, error) {
+	config := bundler.ImageConfig{
+		Env:          c.StringSlice("env"),
+		WorkingDir:   c.String("workdir"),
+		User:         c.String("user"),
+		ExposedPorts: c.StringSlice("expose"),
+	}
+	var err error
+	if config.Entrypoint, err = bundler.ParseCommand(c.String("entrypoint")); err != nil {
+		return config, err
+	}
+	if config.Cmd, err = bundler.ParseCommand(c.String("cmd")); err != nil {
+		return config, err
+	}
+	if config.Labels, err = bundler.ParseLabels(c.StringSlice("label")); err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+// cliPlatformSources returns the sources of each platform image of pack, in the order given.
+// The common sources are added to every platform.
+func cliPlatformSources(platforms, common []string) ([]bundler.PlatformSources, error) {
+	var res []bundler.PlatformSources
+	for _, s := range platforms {
+		p, dir, err := bundler.ParsePlatformSource(s)
+		if err != nil {
+			return nil, err
+		}
+		// The content of dir goes to the image root, to share the paths of the other platforms
+		dir = strings.TrimSuffix(dir, "/") + "/."
+		res = append(res, bundler.PlatformSources{Platform: *p, Sources: append([]string{dir}, common...)})
+	}
+	return res, nil
+}
+
+// cliRegistry returns the options setting the registry credentials and configuration
+func cliRegistry(c *cli.Context) []bundler.Option {
+	var password string
+	if c.Bool("registry-password-stdin") {
+		if c.String("registry-username") == "" {
+			pterm.Fatal.Println("--registry-password-stdin requires --registry-username")
+		}
+		dat, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			pterm.Fatal.Println(err)
+		}
+		password = strings.TrimRight(string(dat), "\r\n")
+	}
+
+	return []bundler.Option{
+		bundler.WithRegistryAuth(c.String("registry-username"), password),
+		bundler.WithRegistryAuthFile(absPath(c.String("registry-auth-file"))),
+		bundler.WithRegistryConfig(loadConfig(c).Registries),
+	}
+}
+
 func cliParse(c *cli.Context) *bundler.Bundler {
+	commands, err := parseAppCommands(c.StringSlice("app-command"))
+	if err != nil {
+		pterm.Fatal.Println(err)
+	}
+
+	if cwd := c.String("app-cwd"); cwd != "" && cwd != "host" && (!path.IsAbs(cwd) || cwd == "/") {
+		pterm.Fatal.Printfln("invalid app cwd '%s', it can be: host, or an absolute path", cwd)
+	}
+
+	for _, p := range c.StringSlice("app-profile") {
+		if !contains(bundler.Profiles, p) {
+			pterm.Fatal.Printfln("unknown profile '%s', available profiles: %s", p, strings.Join(bundler.Profiles, ", "))
+		}
+	}
+
+	images := c.StringSlice("image")
+	if !c.IsSet("image") && len(c.StringSlice("directory")) > 0 {
+		images = nil
+	}
+
 	opts := []bundler.Option{
 		bundler.WithRenderData(
-			c.String("image"),
+			images,
 			c.String("command-prefix"),
 			c.Bool("local"),
-			c.String("directory") == "",
 			bundler.App{
 				Name:        c.String("app-name"),
 				Author:      c.String("app-author"),
@@ -143,9 +450,37 @@ func cliParse(c *cli.Context) *bundler.Bundler {
 				Description: c.String("app-description"),
 				Store:       c.String("app-store"),
 				PocoVersion: pocoVersion(),
+				Strict:      c.BoolT("app-strict"),
+				Commands:    commands,
+				DesktopFile: absPath(c.String("app-desktop-file")),
+				Icon:        absPath(c.String("app-icon")),
+				Profiles:    c.StringSlice("app-profile"),
+				Cwd:         c.String("app-cwd"),
+				Hostname:    c.String("app-hostname"),
 			},
 		),
-		bundler.WithDirectory(c.String("directory")),
+		bundler.WithPlatform(c.String("platform")),
+		bundler.WithLockFile(absPath(c.String("lock-file")), c.Bool("update-lock")),
+		bundler.WithVerifyKey(absPath(c.String("verify-key")), absPaths(c.StringSlice("signature"))...),
+		bundler.WithFilter(cliFilter(c)),
+		bundler.WithCacheDir(absPath(c.String("cache-dir"))),
+	}
+	opts = append(opts, cliRegistry(c)...)
+	if c.Bool("minimize") {
+		opts = append(opts, bundler.WithMinimize(c.StringSlice("keep")...))
+	} else if len(c.StringSlice("keep")) > 0 {
+		pterm.Fatal.Println("--keep requires --minimize")
+	}
+
+	for _, d := range c.StringSlice("directory") {
+		opts = append(opts, bundler.WithDirectory(absPath(d)))
+	}
+	for _, a := range c.StringSlice("add") {
+		src, dst, err := bundler.ParseAdd(a)
+		if err != nil {
+			pterm.Fatal.Println(err)
+		}
+		opts = append(opts, bundler.WithAdd(absPath(src), dst))
 	}
 
 	compression := c.String("compression")
@@ -211,11 +546,17 @@ Render golang generated files to the supplied dir
 				Name:      "extract",
 				Aliases:   []string{"e"},
 				Usage:     "extract a binary and its libraries into a folder",
-				UsageText: "extract <BIN> <DIR>",
+				UsageText: "extract [--root <SYSROOT>] <BIN> <DIR>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "root",
+						Usage: "Sysroot (e.g. an unpacked image) the binary and its libraries are looked up in, in place of the host. The binary path is inside it, and it can be built for another architecture",
+					},
+				},
 				Action: func(c *cli.Context) error {
 					src := c.Args()[0]
 					dst := c.Args()[1]
-					return extractor.Extract(extractor.WithFiles(src), extractor.WithOutputDir(dst))
+					return extractor.Extract(extractor.WithFiles(src), extractor.WithOutputDir(dst), extractor.WithRoot(c.String("root")))
 				},
 			},
 			{
@@ -239,11 +580,19 @@ Render golang generated files to the supplied dir
 			{
 				Name:    "pack",
 				Aliases: []string{"p"},
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:  "destination",
-						Usage: "Destination image tar",
-						Value: "output.tar",
+						Usage: "Destination of the image: a tar for docker-archive (output.tar by default), a directory for oci-layout (output by default)",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Value: bundler.DockerArchive,
+						Usage: "Format of the image written to --destination: " + strings.Join(bundler.PackFormats, ", "),
+					},
+					&cli.BoolFlag{
+						Name:  "push",
+						Usage: "Push the image to its registry. Nothing is written locally unless --destination or --format is given",
 					},
 					&cli.StringFlag{
 						Name:  "os",
@@ -255,38 +604,242 @@ Render golang generated files to the supplied dir
 						Value: runtime.GOARCH,
 						Usage: "Overrides default image ARCH",
 					},
-				},
+					&cli.StringFlag{
+						Name:  "base",
+						Usage: "Append the layers to a base image, keeping its config unless overridden. The image can be prefixed by a transport as with bundle (e.g. oci:/path/to/layout:tag)",
+					},
+					&cli.BoolFlag{
+						Name:  "layer-per-source",
+						Usage: "Create a layer per source, in place of a single layer, so that unchanged sources keep the same layer digest",
+					},
+					&cli.StringSliceFlag{
+						Name:  "platform",
+						Usage: "Pack the content of dir at the root of the image of a platform, as os/arch[/variant]=dir, and create a multi-platform image index. Can be repeated, once per platform. The sources arguments are added to every platform image",
+					},
+					&cli.StringFlag{
+						Name:  "entrypoint",
+						Usage: "Image entrypoint, as a JSON array (e.g. '[\"/bin/app\", \"--flag\"]') or whitespace separated arguments",
+					},
+					&cli.StringFlag{
+						Name:  "cmd",
+						Usage: "Image default command (arguments of the entrypoint), as a JSON array or whitespace separated arguments",
+					},
+					&cli.StringSliceFlag{
+						Name:  "env",
+						Usage: "Image environment variable as KEY=VALUE. Can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "workdir",
+						Usage: "Image working directory",
+					},
+					&cli.StringFlag{
+						Name:  "user",
+						Usage: "Image user, as user[:group] name or id",
+					},
+					&cli.StringSliceFlag{
+						Name:  "label",
+						Usage: "Image label as key=value. Can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "expose",
+						Usage: "Port exposed by the image as port[/tcp|udp|sctp]. Can be repeated",
+					},
+				}, registryFlags()...),
 				Description: `
 Packs files inside a tar which is consumable by docker.
 E.g.
 $ poco --destination out.tar foo/image:tar srcfile1 srcfile2 srcdir1 ...
 $ docker load -i out.tar
 $ docker push foo/image:tar ...
+
+The image config can be set with --entrypoint, --cmd, --env, --workdir, --user, --label and --expose:
+$ poco pack --entrypoint /usr/bin/app --cmd '["--port", "8080"]' --env MODE=prod --expose 8080 foo/image:tar rootfs/
+
+Without a Docker daemon, the image can be pushed to its registry or written as an OCI layout:
+$ poco pack --push registry.example.com/foo/image:tag srcdir1 ...
+$ poco pack --format oci-layout --destination layout/ foo/image:tag srcdir1 ...
+
+A multi-platform image is packed with the files of a directory per platform:
+$ poco pack --push --platform linux/amd64=build/amd64 --platform linux/arm64=build/arm64 registry.example.com/foo/image:tag
+
+The files can be appended to a base image, with a layer per source:
+$ poco pack --base alpine --layer-per-source --cmd /usr/bin/app foo/image:tag deps/ app/
 `,
 				Usage: "pack a directory as a container image",
 				Action: func(c *cli.Context) error {
 					if !c.Args().Present() {
 						return errors.New("need an image and source files to include inside the tar")
 					}
+					if c.IsSet("platform") && (c.IsSet("os") || c.IsSet("arch")) {
+						return errors.New("--os and --arch can't be used with --platform")
+					}
 					if c.Bool("debug") {
 						pterm.EnableDebugMessages()
 					}
-					dst := c.String("destination")
 					img := c.Args().First()
 					src := c.Args().Tail()
 
-					dir, err := os.MkdirTemp("", "containerbay")
+					config, err := cliImageConfig(c)
 					if err != nil {
 						return err
 					}
-					defer os.RemoveAll(dir)
+					out := bundler.PackOutput{
+						Destination: c.String("destination"),
+						Format:      c.String("format"),
+						Push:        c.Bool("push"),
+					}
+					if out.Push && !c.IsSet("destination") && !c.IsSet("format") {
+						out.Format = ""
+					}
+					if out.Destination == "" {
+						switch out.Format {
+						case bundler.DockerArchive:
+							out.Destination = "output.tar"
+						case bundler.OCILayout:
+							out.Destination = "output"
+						}
+					}
 
-					err = archiver.Archive(src, filepath.Join(dir, "archive.tar"))
+					layers := bundler.PackLayers{Base: c.String("base"), PerSource: c.Bool("layer-per-source")}
+					k, err := bundler.New(cliRegistry(c)...)
+					if err != nil {
+						return err
+					}
+					from := src
+					if c.IsSet("platform") {
+						from = append(c.StringSlice("platform"), src...)
+					}
+					if out.Format != "" {
+						pterm.Info.Printfln("Creating '%s' (%s) as '%s' from %v", out.Destination, out.Format, img, from)
+					}
+					if out.Push {
+						pterm.Info.Printfln("Pushing '%s' from %v", img, from)
+					}
+					if c.IsSet("platform") {
+						platforms, err := cliPlatformSources(c.StringSlice("platform"), src)
+						if err != nil {
+							return err
+						}
+						return k.PackIndex(img, platforms, layers, config, out)
+					}
+					return k.Pack(img, src, v1.Platform{OS: c.String("os"), Architecture: c.String("arch")}, layers, config, out)
+				},
+			},
+			{
+				Name: "pack-desktop",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "App name",
+					},
+					&cli.StringFlag{
+						Name:  "description",
+						Usage: "App description",
+					},
+					&cli.StringFlag{
+						Name:  "entrypoint",
+						Usage: "App entrypoint, used to find its desktop entry",
+					},
+					&cli.StringFlag{
+						Name:  "desktop-file",
+						Usage: "Desktop entry to use in place of the one found in the rootfs",
+					},
+					&cli.StringFlag{
+						Name:  "icon",
+						Usage: "Icon to use in place of the one found in the rootfs",
+					},
+				},
+				UsageText: "pack-desktop <ROOTFS> <DIR>",
+				Description: `
+				Collects the desktop entry and icons of an app from a rootfs, to be installed by the bundle.
+				E.g.
+				$ poco pack-desktop --name firefox --entrypoint /usr/bin/firefox assets desktop
+				`,
+				Usage: "pack desktop entry and icons for the bundle",
+				Action: func(c *cli.Context) error {
+					if len(c.Args()) != 2 {
+						return errors.New("need a rootfs and an output directory")
+					}
+					return desktop.Pack(
+						desktop.WithRootfs(c.Args()[0]),
+						desktop.WithOutputDir(c.Args()[1]),
+						desktop.WithApp(c.String("name"), c.String("description"), c.String("entrypoint")),
+						desktop.WithDesktopFile(c.String("desktop-file")),
+						desktop.WithIcon(c.String("icon")),
+					)
+				},
+			},
+			{
+				Name:      "add",
+				UsageText: "add <ROOTFS> <SRC:DST>...",
+				Description: `
+				Adds files or directories into a rootfs, at paths resolved inside it.
+				E.g.
+				$ poco add assets ./app:/usr/bin/app ./config/:/etc/app/
+				`,
+				Usage: "add files into a rootfs",
+				Action: func(c *cli.Context) error {
+					if len(c.Args()) < 2 {
+						return errors.New("need a rootfs and the files to add")
+					}
+					return bundler.AddFiles(c.Args().First(), c.Args().Tail()...)
+				},
+			},
+			{
+				Flags:     common(),
+				Name:      "filter",
+				UsageText: "filter --exclude <RULE> [--include <RULE>] <ROOTFS>",
+				Description: `
+				Removes the files matching the exclude rules from a rootfs, unless they match an include rule.
+				E.g.
+				$ poco filter --exclude docs --exclude /usr/share/locale --include /usr/share/locale/en* assets
+				`,
+				Usage: "remove files from a rootfs",
+				Action: func(c *cli.Context) error {
+					if c.Args().First() == "" {
+						return errors.New("need a rootfs to filter")
+					}
+					files, size, err := bundler.FilterRootfs(c.Args().First(), cliFilter(c))
+					if err != nil {
+						return err
+					}
+					pterm.Info.Printfln("Removed %d files, %s", files, units.HumanSize(float64(size)))
+					return nil
+				},
+			},
+			{
+				Name:      "minimize",
+				UsageText: "minimize --entrypoint <BIN> [--keep <PATH>] <ROOTFS>",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "entrypoint",
+						Usage: "A binary of the rootfs to keep, with the libraries it loads. Can be specified multiple times",
+					},
+					&cli.StringSliceFlag{
+						Name:  "keep",
+						Usage: "A path (or glob) of the rootfs to keep, with its content and the libraries it needs. Can be specified multiple times",
+					},
+				},
+				Description: `
+				Removes from a rootfs everything not needed by the entrypoints and the kept paths.
+				The libraries are resolved by reading the ELF files, as the dynamic loader of the rootfs would, without running them.
+				E.g.
+				$ poco minimize --entrypoint /usr/bin/curl --keep /etc/ssl assets
+				`,
+				Usage: "reduce a rootfs to the dependencies of its entrypoints",
+				Action: func(c *cli.Context) error {
+					if c.Args().First() == "" {
+						return errors.New("need a rootfs to minimize")
+					}
+					removed, files, size, err := bundler.Minimize(c.Args().First(), c.StringSlice("entrypoint"), c.StringSlice("keep"))
 					if err != nil {
 						return err
 					}
-					pterm.Info.Printfln("Creating '%s' as '%s' from %v", dst, img, src)
-					return image.CreateTar(filepath.Join(dir, "archive.tar"), dst, img, c.String("arch"), c.String("os"))
+					for _, r := range removed {
+						fmt.Println("Dropped", r)
+					}
+					pterm.Info.Printfln("Removed %d files, %s", files, units.HumanSize(float64(size)))
+					return nil
 				},
 			},
 			{
@@ -352,7 +905,7 @@ $ docker push foo/image:tar ...
 						os.Chdir(changeDir)
 					}
 
-					err := archiver.Archive(src, dst)
+					err := bundler.PackAssets(src, dst)
 					if err != nil {
 						return err
 					}
@@ -397,10 +950,10 @@ It also associates to automatically mount /sys, /tmp and /run by default when st
 					k := cliParse(c)
 
 					pterm.Info.Printfln(
-						"Creating bundle '%s' (version %s) from image '%s' with entrypoint '%s'",
+						"Creating bundle '%s' (version %s) from '%s' with entrypoint '%s'",
 						c.String("app-name"),
 						c.String("app-version"),
-						c.String("image"),
+						strings.Join(k.Images(), "', '"),
 						c.String("entrypoint"),
 					)
 
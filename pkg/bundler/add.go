@@ -0,0 +1,170 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+// ParseAdd parses a file to add to a rootfs in the src:dst form. dst must be absolute.
+func ParseAdd(s string) (string, string, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || !path.IsAbs(s[i+1:]) {
+		return "", "", fmt.Errorf("invalid add '%s', it must be in the form src:/path/in/image", s)
+	}
+	return s[:i], s[i+1:], nil
+}
+
+// AddFiles copies files or directories into a rootfs, given as src:dst.
+// dst is resolved inside the rootfs, following its symlinks without escaping it.
+// If dst ends with a slash or is an existing directory, src is copied inside it.
+// The copied files replace the rootfs symlinks instead of writing through them.
+func AddFiles(rootfs string, adds ...string) error {
+	for _, a := range adds {
+		src, dst, err := ParseAdd(a)
+		if err != nil {
+			return err
+		}
+		target, err := securejoin.SecureJoin(rootfs, dst)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(target); strings.HasSuffix(dst, "/") || (err == nil && fi.IsDir()) {
+			target = filepath.Join(target, filepath.Base(src))
+		}
+		name, err := filepath.Rel(rootfs, target)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Adding", src, "as", dst)
+		if err := addTree(rootfs, src, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rootfsPath returns the path of name in the rootfs. The symlinks of its parent
+// directories are resolved inside the rootfs, the last element is not followed.
+func rootfsPath(rootfs, name string) (string, error) {
+	name = filepath.Clean("/" + name)
+	dir, err := securejoin.SecureJoin(rootfs, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(name)), nil
+}
+
+// addTree copies src as name in the rootfs, resolving every written path with rootfsPath
+func addTree(rootfs, src, name string) error {
+	var dirs []string
+	var modes []os.FileMode
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		to, err := rootfsPath(rootfs, filepath.Join(name, rel))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			// Existing directories are kept, including symlinks to directories of the rootfs
+			if resolved, err := securejoin.SecureJoin(rootfs, filepath.Join(name, rel)); err == nil {
+				if fi, err := os.Stat(resolved); err == nil && fi.IsDir() {
+					return nil
+				}
+			}
+			if err := replace(to); err != nil {
+				return err
+			}
+			if err := os.Mkdir(to, 0755); err != nil {
+				return err
+			}
+			// The mode is set once the directory content is copied, as it could prevent writing it
+			dirs = append(dirs, to)
+			modes = append(modes, info.Mode().Perm())
+			return nil
+		}
+
+		if err := replace(to); err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, to)
+		case info.Mode().IsRegular():
+			return copyFile(p, to, info.Mode().Perm())
+		}
+		return fmt.Errorf("can't add '%s': unsupported file type %s", p, info.Mode().Type())
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], modes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace removes the file at p, without following it if it is a symlink
+func replace(p string) error {
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode)
+}
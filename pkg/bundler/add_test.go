@@ -0,0 +1,77 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddFilesSymlinks(t *testing.T) {
+	host := t.TempDir()
+	writeTree(t, host, map[string]string{"conf": "host"})
+
+	rootfs := t.TempDir()
+	writeTree(t, rootfs, map[string]string{
+		"usr/lib/libc.so": "libc",
+		"lib":             "->usr/lib",
+		"opt/app/conf":    "->" + filepath.Join(host, "conf"),
+		"opt/app/data":    "->" + host,
+	})
+
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"app/conf":      "app",
+		"app/data/conf": "app",
+		"app/bin/app":   "app",
+		"lib/libapp.so": "libapp",
+	})
+
+	if err := AddFiles(rootfs, filepath.Join(src, "app")+":/opt/", filepath.Join(src, "lib")+":/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The host files the rootfs symlinks point to are untouched
+	if dat, err := ioutil.ReadFile(filepath.Join(host, "conf")); err != nil || string(dat) != "host" {
+		t.Fatalf("expected the host file to be untouched, got %q (%v)", dat, err)
+	}
+	if files, _ := ioutil.ReadDir(host); len(files) != 1 {
+		t.Fatalf("expected no file to be added to the host directory, got %d files", len(files))
+	}
+
+	for p, content := range map[string]string{
+		"opt/app/conf":    "app",
+		"opt/app/bin/app": "app",
+		// A symlink to a directory missing in the rootfs is replaced
+		"opt/app/data/conf": "app",
+		// The symlinks to directories of the rootfs are followed
+		"usr/lib/libapp.so": "libapp",
+		"usr/lib/libc.so":   "libc",
+	} {
+		dat, err := ioutil.ReadFile(filepath.Join(rootfs, p))
+		if err != nil || string(dat) != content {
+			t.Fatalf("expected %s to contain %q, got %q (%v)", p, content, dat, err)
+		}
+	}
+	if fi, err := os.Lstat(filepath.Join(rootfs, "opt/app/conf")); err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		t.Fatalf("expected the conf symlink to be replaced: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(rootfs, "lib")); err != nil || target != "usr/lib" {
+		t.Fatalf("expected the lib symlink to be kept, got %s (%v)", target, err)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/mholt/archiver/v3"
+	"golang.org/x/sys/unix"
+)
+
+// paxSchilyXattr is the PAX record prefix of the extended attributes, as written by GNU tar and containers
+const paxSchilyXattr = "SCHILY.xattr."
+
+// Xattrs returns the extended attributes of a file, without following symlinks
+func Xattrs(p string) (map[string]string, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size == 0 {
+		if err == unix.ENOTSUP {
+			err = nil
+		}
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(p, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]string{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(p, name, nil)
+		if err != nil {
+			// e.g. trusted.* attributes, only readable by root
+			continue
+		}
+		value := make([]byte, vsize)
+		vsize, err = unix.Lgetxattr(p, name, value)
+		if err != nil {
+			continue
+		}
+		res[name] = string(value[:vsize])
+	}
+	return res, nil
+}
+
+// compressor returns the compressor of an archive, from its extension.
+// A nil compressor is returned for plain tarballs.
+func compressor(dst string) (archiver.Compressor, error) {
+	format, err := archiver.ByExtension(dst)
+	if err != nil {
+		return nil, err
+	}
+	switch format.(type) {
+	case *archiver.Tar:
+		return nil, nil
+	case *archiver.TarBrotli:
+		return archiver.NewBrotli(), nil
+	case *archiver.TarBz2:
+		return archiver.NewBz2(), nil
+	case *archiver.TarGz:
+		return archiver.NewGz(), nil
+	case *archiver.TarLz4:
+		return archiver.NewLz4(), nil
+	case *archiver.TarSz:
+		return archiver.NewSnappy(), nil
+	case *archiver.TarXz:
+		return archiver.NewXz(), nil
+	case *archiver.TarZstd:
+		return archiver.NewZstd(), nil
+	}
+	return nil, fmt.Errorf("format specified by destination filename is not a tar format: %s (%T)", dst, format)
+}
+
+// fileID identifies a file with multiple hard links
+type fileID struct {
+	dev, ino uint64
+}
+
+// PackAssets archives the sources into dst, compressed according to its extension.
+// Unlike archiver.Archive, the extended attributes (e.g. file capabilities) are stored as PAX records,
+// and the device numbers and hard links are kept.
+func PackAssets(sources []string, dst string) error {
+	comp, err := compressor(dst)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// The tarball is piped through the compressor
+	var w io.WriteCloser = out
+	compressed := make(chan error, 1)
+	if comp == nil {
+		compressed <- nil
+	} else {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		go func() {
+			err := comp.Compress(pr, out)
+			pr.CloseWithError(err)
+			compressed <- err
+		}()
+		w = pw
+	}
+	tw := tar.NewWriter(w)
+
+	dstAbs, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	links := map[fileID]string{}
+	for _, source := range sources {
+		sourceInfo, err := os.Stat(source)
+		if err != nil {
+			return err
+		}
+		err = filepath.Walk(source, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// Don't archive the output into itself
+			if abs, err := filepath.Abs(p); err == nil && abs == dstAbs {
+				return nil
+			}
+			name, err := archiver.NameInArchive(sourceInfo, source, p)
+			if err != nil {
+				return err
+			}
+			return writeAsset(tw, p, name, info, links)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if comp != nil {
+		w.Close()
+	}
+	if err := <-compressed; err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// writeAsset writes the file at p in the archive as name. Files already archived
+// under another name are written as hard links to it.
+func writeAsset(tw *tar.Writer, p, name string, info os.FileInfo, links map[fileID]string) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, filepath.ToSlash(link))
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(name)
+	if info.IsDir() && !strings.HasSuffix(hdr.Name, "/") {
+		hdr.Name += "/"
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && !info.IsDir() && st.Nlink > 1 {
+		id := fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+		if first, ok := links[id]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			links[id] = hdr.Name
+		}
+	}
+
+	xattrs, err := Xattrs(p)
+	if err != nil {
+		return err
+	}
+	if len(xattrs) > 0 {
+		hdr.PAXRecords = map[string]string{}
+		for k, v := range xattrs {
+			hdr.PAXRecords[paxSchilyXattr+k] = v
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
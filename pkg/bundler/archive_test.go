@@ -0,0 +1,143 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// extractMain runs the extraction of the bundle on an archive
+const extractMain = `package main
+
+import "os"
+
+func main() {
+	if err := extractAssets(os.Args[1], os.Args[2], false); err != nil {
+		panic(err)
+	}
+}
+`
+
+// buildExtract builds a program extracting archives with the extract.go of the bundle
+func buildExtract(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is required to build the bundle extraction")
+	}
+	dir := t.TempDir()
+	src, err := assets.ReadFile("gen/extract.go.template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"extract.go": src, "main.go": []byte(extractMain)}
+	// The bundle dependencies are a subset of poco ones
+	for _, f := range []string{"go.mod", "go.sum"} {
+		if files[f], err = ioutil.ReadFile(filepath.Join("..", "..", f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, dat := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), dat, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bin := filepath.Join(dir, "extract")
+	cmd := exec.Command("go", "build", "-o", bin, ".")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed building the extraction: %s\n%s", err, out)
+	}
+	return bin
+}
+
+func TestPackAssetsRoundTrip(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("creating devices requires root")
+	}
+	extract := buildExtract(t)
+
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"bin/app":  "app",
+		"bin/link": "->app",
+	})
+	if err := unix.Mknod(filepath.Join(src, "null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mkfifo(filepath.Join(src, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "bin/app"), filepath.Join(src, "bin/hardlink")); err != nil {
+		t.Fatal(err)
+	}
+	xattr := unix.Lsetxattr(filepath.Join(src, "bin/app"), "user.poco", []byte("test"), 0) == nil
+
+	for _, archive := range []string{"assets.tar", "assets.tar.zst"} {
+		t.Run(archive, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), archive)
+			if err := PackAssets([]string{src + "/."}, archive); err != nil {
+				t.Fatal(err)
+			}
+			dst := t.TempDir()
+			if out, err := exec.Command(extract, archive, dst).CombinedOutput(); err != nil {
+				t.Fatalf("failed extracting: %s\n%s", err, out)
+			}
+
+			var null unix.Stat_t
+			if err := unix.Lstat(filepath.Join(dst, "null"), &null); err != nil {
+				t.Fatal(err)
+			}
+			if null.Mode&unix.S_IFMT != unix.S_IFCHR || unix.Major(null.Rdev) != 1 || unix.Minor(null.Rdev) != 3 {
+				t.Fatalf("expected the 1,3 character device, got mode %o and device %d,%d", null.Mode, unix.Major(null.Rdev), unix.Minor(null.Rdev))
+			}
+			if fi, err := os.Lstat(filepath.Join(dst, "fifo")); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+				t.Fatalf("expected a fifo: %v", err)
+			}
+			if target, err := os.Readlink(filepath.Join(dst, "bin/link")); err != nil || target != "app" {
+				t.Fatalf("expected the symlink to app, got %s (%v)", target, err)
+			}
+
+			app, err := os.Stat(filepath.Join(dst, "bin/app"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			hardlink, err := os.Stat(filepath.Join(dst, "bin/hardlink"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(app, hardlink) {
+				t.Fatal("expected bin/hardlink to be a hard link to bin/app")
+			}
+			if dat, err := ioutil.ReadFile(filepath.Join(dst, "bin/hardlink")); err != nil || string(dat) != "app" {
+				t.Fatalf("unexpected hard link content %q (%v)", dat, err)
+			}
+
+			if xattr {
+				attrs, err := Xattrs(filepath.Join(dst, "bin/app"))
+				if err != nil || attrs["user.poco"] != "test" {
+					t.Fatalf("expected the user.poco attribute to be restored, got %v (%v)", attrs, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+)
+
+// WithRegistryAuth sets the credentials used to pull and push the images given to the bundler,
+// in place of the ones configured on the system. They are only sent to the registries of these images.
+func WithRegistryAuth(username, password string) Option {
+	return func(k *Bundler) error {
+		if username == "" {
+			return nil
+		}
+		k.auth = &authn.Basic{Username: username, Password: password}
+		return nil
+	}
+}
+
+// WithRegistryAuthFile sets a docker config.json formatted file to read the registries credentials from
+func WithRegistryAuthFile(s string) Option {
+	return func(k *Bundler) error {
+		k.authFile = s
+		return nil
+	}
+}
+
+// authFileKeychain resolves the registries credentials from a docker config.json formatted file
+type authFileKeychain string
+
+// Resolve implements authn.Keychain
+func (a authFileKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	f, err := os.Open(string(a))
+	if os.IsNotExist(err) {
+		return authn.Anonymous, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cf, err := config.LoadFromReader(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading auth file '%s'", string(a))
+	}
+
+	cfg, err := cf.GetAuthConfig(authKey(target))
+	if err != nil {
+		return nil, err
+	}
+	if cfg == (types.AuthConfig{}) {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
+
+// authKey returns the key of a registry in docker config files
+func authKey(target authn.Resource) string {
+	if target.RegistryStr() == name.DefaultRegistry {
+		return authn.DefaultAuthKey
+	}
+	return target.RegistryStr()
+}
+
+// staticKeychain resolves the registries to the same credentials
+type staticKeychain struct {
+	auth       authn.Authenticator
+	registries []string
+}
+
+// Resolve implements authn.Keychain
+func (s staticKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if !contains(s.registries, target.RegistryStr()) {
+		return authn.Anonymous, nil
+	}
+	return s.auth, nil
+}
+
+// imageRegistry returns the registry of image, empty if it doesn't come from a registry.
+// The image can be prefixed by its transport.
+func (k *Bundler) imageRegistry(image string) (string, error) {
+	transport, ref := k.SplitTransport(image)
+	if transport != TransportRegistry || ref == "" {
+		return "", nil
+	}
+	r, err := k.registry.ParseReference(strings.TrimPrefix(ref, "//"))
+	if err != nil {
+		return "", err
+	}
+	return r.Context().RegistryStr(), nil
+}
+
+// authorize sends the explicit credentials to the registry of image
+func (k *Bundler) authorize(image string) error {
+	r, err := k.imageRegistry(image)
+	if err != nil || r == "" {
+		return err
+	}
+	k.authRegistries = append(k.authRegistries, r)
+	return nil
+}
+
+// keychain returns the keychain used to pull images. Credentials are looked up in order from
+// the explicit ones for the registries of the bundled images, the auth file, $REGISTRY_AUTH_FILE
+// and the docker config ($DOCKER_CONFIG or ~/.docker/config.json, including the credential helpers)
+func (k *Bundler) keychain() authn.Keychain {
+	var keychains []authn.Keychain
+	if k.auth != nil {
+		registries := append([]string{}, k.authRegistries...)
+		for _, image := range k.images {
+			if r, err := k.imageRegistry(image); err == nil && r != "" {
+				registries = append(registries, r)
+			}
+		}
+		keychains = append(keychains, staticKeychain{auth: k.auth, registries: registries})
+	}
+	if k.authFile != "" {
+		keychains = append(keychains, authFileKeychain(k.authFile))
+	}
+	if f := os.Getenv("REGISTRY_AUTH_FILE"); f != "" {
+		keychains = append(keychains, authFileKeychain(f))
+	}
+	return authn.NewMultiKeychain(append(keychains, authn.DefaultKeychain)...)
+}
+
+// writeAuthFile resolves the credentials for the registries of the images, and of their mirrors if any,
+// and writes them in a docker config.json formatted file at dst.
+// It returns false if no credentials are needed.
+func (k *Bundler) writeAuthFile(images []string, dst string) (bool, error) {
+	var registries []name.Repository
+	for _, image := range images {
+		transport, image := k.SplitTransport(image)
+		if transport != TransportRegistry {
+			continue
+		}
+		ref, err := k.registry.ParseReference(strings.TrimPrefix(image, "//"))
+		if err != nil {
+			return false, err
+		}
+		registries = append(registries, ref.Context())
+		if m, ok, err := k.registry.mirror(ref); err != nil {
+			return false, err
+		} else if ok {
+			registries = append(registries, m.Context())
+		}
+	}
+
+	auths := map[string]*authn.AuthConfig{}
+	for _, r := range registries {
+		auth, err := k.keychain().Resolve(r)
+		if err != nil {
+			return false, err
+		}
+		if auth == authn.Anonymous {
+			continue
+		}
+
+		cfg, err := auth.Authorization()
+		if err != nil {
+			return false, err
+		}
+		if cfg.Auth == "" && cfg.Username != "" {
+			cfg.Auth = base64.StdEncoding.EncodeToString([]byte(cfg.Username + ":" + cfg.Password))
+			cfg.Username, cfg.Password = "", ""
+		}
+		auths[authKey(r)] = cfg
+	}
+	if len(auths) == 0 {
+		return false, nil
+	}
+
+	dat, err := json.Marshal(map[string]map[string]*authn.AuthConfig{"auths": auths})
+	if err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(dst, dat, 0600)
+}
@@ -0,0 +1,180 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// authRegistry starts an in-process registry requiring the basic auth credentials,
+// and returns its host and the count of requests carrying credentials
+func authRegistry(t *testing.T, username, password string) (string, *int32) {
+	t.Helper()
+	var authorized int32
+	reg := registry.New(registry.Logger(log.New(ioutil.Discard, "", 0)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if ok {
+			atomic.AddInt32(&authorized, 1)
+		}
+		if !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="poco"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://"), &authorized
+}
+
+// writeAuthConfig writes a docker config.json with the credentials for host
+func writeAuthConfig(t *testing.T, file, host, username, password string) {
+	t.Helper()
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	dat := fmt.Sprintf(`{"auths": {"%s": {"auth": "%s"}}}`, host, auth)
+	if err := ioutil.WriteFile(file, []byte(dat), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	// Don't pick the credentials of the system
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	t.Setenv("REGISTRY_AUTH_FILE", "")
+
+	host, _ := authRegistry(t, "user", "secret")
+	image := host + "/test/app:latest"
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(512, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: "user", Password: "secret"})); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name  string
+		setup func(t *testing.T) []Option
+		fail  bool
+	}{
+		{name: "no credentials", fail: true, setup: func(t *testing.T) []Option { return nil }},
+		{name: "explicit credentials", setup: func(t *testing.T) []Option {
+			return []Option{WithRegistryAuth("user", "secret")}
+		}},
+		{name: "wrong explicit credentials", fail: true, setup: func(t *testing.T) []Option {
+			return []Option{WithRegistryAuth("user", "wrong")}
+		}},
+		{name: "auth file", setup: func(t *testing.T) []Option {
+			file := filepath.Join(t.TempDir(), "auth.json")
+			writeAuthConfig(t, file, host, "user", "secret")
+			return []Option{WithRegistryAuthFile(file)}
+		}},
+		{name: "REGISTRY_AUTH_FILE", setup: func(t *testing.T) []Option {
+			file := filepath.Join(t.TempDir(), "auth.json")
+			writeAuthConfig(t, file, host, "user", "secret")
+			t.Setenv("REGISTRY_AUTH_FILE", file)
+			return nil
+		}},
+		{name: "DOCKER_CONFIG", setup: func(t *testing.T) []Option {
+			dir := t.TempDir()
+			writeAuthConfig(t, filepath.Join(dir, "config.json"), host, "user", "secret")
+			t.Setenv("DOCKER_CONFIG", dir)
+			return nil
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opts := append(c.setup(t), WithRegistryConfig(RegistryConfig{Insecure: []string{host}}), WithPlatform("linux/amd64"))
+			k, err := New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = k.DownloadImage(image, t.TempDir(), false)
+			if c.fail && err == nil {
+				t.Fatal("expected the pull to fail")
+			} else if !c.fail && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRegistryAuthScope(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	t.Setenv("REGISTRY_AUTH_FILE", "")
+
+	host, _ := authRegistry(t, "user", "secret")
+	mirror, mirrorAuthorized := authRegistry(t, "mirror", "mirror")
+	image := host + "/test/app:latest"
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(512, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: "user", Password: "secret"})); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := New(
+		WithRegistryAuth("user", "secret"),
+		WithRegistryConfig(RegistryConfig{Insecure: []string{host, mirror}, Mirrors: map[string]string{host: mirror}}),
+		WithPlatform("linux/amd64"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pull falls back from the mirror to the registry
+	if err := k.DownloadImage(image, t.TempDir(), false); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(mirrorAuthorized); n != 0 {
+		t.Fatalf("the explicit credentials were sent %d times to the mirror", n)
+	}
+
+	other, err := name.NewRegistry("other.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := k.keychain().Resolve(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != authn.Anonymous {
+		t.Fatal("the explicit credentials are resolved for a registry other than the image one")
+	}
+}
@@ -18,12 +18,14 @@ package bundler
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
 
@@ -31,14 +33,11 @@ import (
 
 	"github.com/Masterminds/sprig/v3"
 	containerdarchive "github.com/containerd/containerd/archive"
-	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/authn"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/mholt/archiver/v3"
 	"github.com/otiai10/copy"
-	cp "github.com/otiai10/copy"
 	"github.com/pkg/errors"
 )
 
@@ -55,16 +54,70 @@ type App struct {
 	Attrs       []string
 	Store       string
 	PocoVersion string
+	// Strict makes the bundle abort when the sandbox setup fails
+	Strict bool
+	// Commands maps command names to paths inside the bundle.
+	// The bundle runs the command if invoked with its name (e.g. via a symlink)
+	// or if the name is the first argument
+	Commands map[string]string
+	// DesktopFile and Icon are installed by the bundle install-desktop command.
+	// If empty, they are looked up in the bundled rootfs
+	DesktopFile string
+	Icon        string
+	// Profiles are the default profiles sharing host resources with the app (e.g. gui)
+	Profiles []string
+	// Cwd is where the current directory is shared inside the app
+	// ("host" for the same path, empty to disable)
+	Cwd string
+	// Hostname of the app, defaults to its name
+	Hostname string
+}
+
+// Profiles are the profiles supported by bundles
+var Profiles = []string{"gui", "none"}
+
+// CommandNames returns the sorted names of the app commands
+func (a App) CommandNames() []string {
+	names := []string{}
+	for n := range a.Commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // bundleData is the parent structure which is used by the template
 type bundleData struct {
-	Image         string
+	// Images are unpacked in order, each one on top of the previous ones
+	Images        []string
 	LocalBuild    bool
 	App           App
 	CommandPrefix string
 	Compression   string
-	UnpackImage   bool
+	// Adds are the files added on top of the images, as src:dst
+	Adds []string
+	// AuthFile holds the registry credentials of the user running the build,
+	// as the image is unpacked with the command prefix (e.g. as root)
+	AuthFile string
+	// Registry is the registry configuration of the user running the build
+	Registry RegistryConfig
+	// Platform is the platform of the images to unpack
+	Platform string
+	// Pinned are the registry images pinned to their digests by the lock file
+	Pinned []string
+	// VerifyKey is the public key verifying the images signatures, read from the Signatures files
+	// or from the registries
+	VerifyKey  string
+	Signatures []string
+	// Filter drops files from the rootfs once the images are unpacked and the files added
+	Filter Filter
+	// Minimize keeps only the app binaries, the Keep paths and what they need to run
+	Minimize bool
+	Keep     []string
+	// CacheDir is the blob cache of the user running the build, empty if disabled
+	CacheDir string
+	// Profiles are the profiles supported by the bundle
+	Profiles []string
 }
 
 // Bundler is the poCo application
@@ -72,7 +125,26 @@ type bundleData struct {
 type Bundler struct {
 	stateDir   string
 	renderData bundleData
-	directory  string
+	images     []string
+	adds       []string
+	auth       authn.Authenticator
+	// authRegistries are the registries the explicit credentials are sent to
+	authRegistries []string
+	authFile       string
+	registry       RegistryConfig
+	sources        map[string]ImageSource
+	platform       *v1.Platform
+	lockFile       string
+	updateLock     bool
+	filter         Filter
+	minimize       bool
+	keep           []string
+	cache          *BlobCache
+
+	verifyKey      crypto.PublicKey
+	verifyKeyFile  string
+	signatures     []Signature
+	signatureFiles []string
 }
 
 // WithStateDir sets the bundler application state directory
@@ -83,10 +155,23 @@ func WithStateDir(s string) Option {
 	}
 }
 
-// WithDirectory sets the bundler input dir to bundle
+// WithDirectory adds a directory to bundle, on top of the images
 func WithDirectory(s string) Option {
 	return func(k *Bundler) error {
-		k.directory = s
+		if s != "" {
+			k.images = append(k.images, TransportDir+":"+s)
+		}
+		return nil
+	}
+}
+
+// WithAdd adds a file or directory at dst in the bundle, on top of the images and directories
+func WithAdd(src, dst string) Option {
+	return func(k *Bundler) error {
+		if !path.IsAbs(dst) {
+			return fmt.Errorf("destination of '%s' must be an absolute path, got '%s'", src, dst)
+		}
+		k.adds = append(k.adds, src+":"+dst)
 		return nil
 	}
 }
@@ -104,14 +189,21 @@ func WithCompression(c string) Option {
 	}
 }
 
-// WithRenderData sets the data to be rendered when creating the application bundle
-func WithRenderData(image, commandprefix string, localbuild, unpackImage bool, a App) Option {
+// WithRenderData sets the data to be rendered when creating the application bundle.
+// The images are layered in order, the directories set with WithDirectory go on top of them.
+func WithRenderData(images []string, commandprefix string, localbuild bool, a App) Option {
 	return func(k *Bundler) error {
-		k.renderData = bundleData{Image: image, LocalBuild: localbuild, CommandPrefix: commandprefix, App: a, UnpackImage: unpackImage}
+		k.renderData = bundleData{LocalBuild: localbuild, CommandPrefix: commandprefix, App: a}
+		k.images = append(append([]string{}, images...), k.images...)
 		return nil
 	}
 }
 
+// Images returns the images to bundle, in the order they are layered
+func (k *Bundler) Images() []string {
+	return k.images
+}
+
 // Option is a Bundler option
 type Option func(k *Bundler) error
 
@@ -122,6 +214,7 @@ func New(o ...Option) (*Bundler, error) {
 			Compression: "zst",
 		},
 	}
+	k.sources = k.defaultSources()
 	for _, oo := range o {
 		if err := oo(k); err != nil {
 			return nil, err
@@ -137,10 +230,35 @@ func (k *Bundler) Build(dst string, args ...string) error {
 		return err
 	}
 	defer os.RemoveAll(tempdir)
-	err = k.Render(tempdir)
+
+	images := k.images
+	if k.lockFile != "" && !k.renderData.LocalBuild {
+		images, err = k.lock(k.images)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !k.renderData.LocalBuild {
+		authFile := filepath.Join(tempdir, "auth.json")
+		found, err := k.writeAuthFile(images, authFile)
+		if err != nil {
+			return errors.Wrap(err, "failure while resolving registry credentials")
+		}
+		if found {
+			k.renderData.AuthFile = authFile
+		}
+	}
+
+	err = k.render(tempdir, images)
 	if err != nil {
 		return err
 	}
+	if k.platform != nil && k.platform.Architecture != goArch() {
+		fmt.Fprintf(os.Stderr, "Warning: the bundle is built for %s while the image platform is %s, set GOARCH=%s to build it for the image architecture\n",
+			goArch(), platformString(*k.platform), k.platform.Architecture)
+	}
+
 	oFile := path.Base(dst)
 
 	err = k.goBuild(tempdir, oFile)
@@ -191,12 +309,37 @@ func (k *Bundler) goBuild(rendered string, binary string, args ...string) error
 
 // Render creates the application data at dst
 func (k *Bundler) Render(dst string) error {
-	if k.directory != "" {
-		err := cp.Copy(k.directory, filepath.Join(dst, "assets"))
+	return k.render(dst, k.images)
+}
+
+func (k *Bundler) render(dst string, images []string) error {
+	k.renderData.Registry = k.registry
+	k.renderData.Platform = platformString(k.Platform())
+	k.renderData.VerifyKey = k.verifyKeyFile
+	k.renderData.Signatures = k.signatureFiles
+	// The images are unpacked from the render directory
+	k.renderData.Images = nil
+	k.renderData.Pinned = nil
+	for _, i := range images {
+		image, err := k.AbsImage(i)
 		if err != nil {
 			return err
 		}
+		k.renderData.Images = append(k.renderData.Images, image)
+		if transport, ref := k.SplitTransport(image); transport == TransportRegistry && strings.Contains(ref, "@") {
+			k.renderData.Pinned = append(k.renderData.Pinned, ref)
+		}
+	}
+	k.renderData.Adds = k.adds
+	k.renderData.Filter = k.filter
+	k.renderData.Minimize = k.minimize
+	k.renderData.Keep = k.keep
+	k.renderData.CacheDir = ""
+	if k.cache != nil {
+		k.renderData.CacheDir = k.cache.Dir
 	}
+	k.renderData.Profiles = Profiles
+
 	return fs.WalkDir(
 		assets,
 		".",
@@ -235,28 +378,37 @@ func (k *Bundler) Render(dst string) error {
 }
 
 // DownloadImage downloads a container image locally.
+// The image can be prefixed by its transport (e.g. oci:/path), see ImageSource.
 func (k *Bundler) DownloadImage(image, dst string, local bool) error {
 	os.MkdirAll(dst, os.ModePerm)
-	ref, err := name.ParseReference(image)
-	if err != nil {
-		return err
-	}
-
-	var img v1.Image
 
-	if local {
-		img, err = daemon.Image(ref, daemon.WithUnbufferedOpener())
-		if err != nil {
-			return errors.Wrap(err, "failure while retreiving image from daemon")
+	transport, ref := k.SplitTransport(image)
+	if local && transport == TransportRegistry {
+		transport = TransportDaemon
+	}
+	if transport == TransportRegistry {
+		if err := k.authorize(ref); err != nil {
+			return errors.Wrapf(err, "failure while retrieving image '%s'", image)
 		}
-	} else {
-		// If we fail to provide from daemon, get it remotely
-		img, err = remote.Image(ref)
-		if err != nil {
-			return errors.Wrap(err, "failure while downloading image")
+	}
+	if k.verifyKey != nil && transport == TransportRegistry {
+		var err error
+		if ref, err = k.pinDigest(ref); err != nil {
+			return errors.Wrapf(err, "failure while retrieving image '%s'", image)
 		}
 	}
 
+	img, err := k.sources[transport].Image(ref)
+	if err != nil {
+		return errors.Wrapf(err, "failure while retrieving image '%s'", image)
+	}
+	if err := k.verifyPlatform(img); err != nil {
+		return errors.Wrapf(err, "failure while retrieving image '%s'", image)
+	}
+	if err := k.verifyImage(transport, ref, img); err != nil {
+		return errors.Wrapf(err, "failure while verifying image '%s'", image)
+	}
+
 	reader := mutate.Extract(img)
 
 	defer reader.Close()
@@ -0,0 +1,430 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// maxFetchAttempts is the number of times a blob download is resumed before giving up
+const maxFetchAttempts = 3
+
+// BlobFetcher returns a reader of a blob starting at offset, and whether the offset was honored
+type BlobFetcher func(offset int64) (io.ReadCloser, bool, error)
+
+// BlobCache stores the layers pulled from registries by digest, and is shared by the poco commands
+type BlobCache struct {
+	Dir string
+}
+
+// DefaultCacheDir returns the poco directory in the user cache, e.g. ~/.cache/poco
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "poco")
+}
+
+// WithCacheDir sets the directory caching the layers pulled from registries. The cache is disabled if empty.
+func WithCacheDir(dir string) Option {
+	return func(k *Bundler) error {
+		k.cache = nil
+		if dir != "" {
+			k.cache = &BlobCache{Dir: dir}
+		}
+		return nil
+	}
+}
+
+// Path returns the path of a blob in the cache
+func (c *BlobCache) Path(h v1.Hash) string {
+	return filepath.Join(c.Dir, "blobs", h.Algorithm, h.Hex)
+}
+
+// Get returns the path of the blob in the cache, downloading it with fetch if needed.
+// Interrupted downloads are resumed, and blobs are stored once verified against their digest and size.
+func (c *BlobCache) Get(h v1.Hash, size int64, fetch BlobFetcher) (string, error) {
+	p := c.Path(h)
+	if cached(p, size) {
+		return p, nil
+	}
+	if err := mkdirAllOwned(filepath.Dir(p)); err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(p+".partial", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	chownSudoUser(f.Name())
+
+	// Another poco may be downloading the same blob
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return "", err
+	}
+	if cached(p, size) {
+		return p, nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = c.download(f, h, size, fetch)
+		if err == nil {
+			break
+		}
+		if attempt == maxFetchAttempts {
+			return "", errors.Wrapf(err, "failure while downloading %s", h)
+		}
+		fmt.Fprintf(os.Stderr, "Downloading %s failed, retrying: %s\n", h, err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// Open returns a reader of the blob in the cache, downloading it with fetch if needed.
+// As the cache is writable by its user while poco can run as root, the cached blob is verified
+// against its digest: it is downloaded again if it doesn't match. It is verified again while it is read,
+// in case it is modified meanwhile: the reader fails then at its end, and the blob is removed from the cache.
+func (c *BlobCache) Open(h v1.Hash, size int64, fetch BlobFetcher) (io.ReadCloser, error) {
+	for attempt := 1; ; attempt++ {
+		p, err := c.Get(h, size, fetch)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		got, n, err := v1.SHA256(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if got == h && (size <= 0 || n == size) {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				f.Close()
+				return nil, err
+			}
+			return newVerifiedBlob(f, h, size, func(got v1.Hash, n int64) error {
+				os.Remove(p)
+				return fmt.Errorf("cached blob %s doesn't match, got %s (%d bytes): it was removed from the cache", h, got, n)
+			}), nil
+		}
+
+		f.Close()
+		os.Remove(p)
+		if attempt == maxFetchAttempts {
+			return nil, fmt.Errorf("cached blob %s doesn't match, got %s (%d bytes)", h, got, n)
+		}
+		fmt.Fprintf(os.Stderr, "Cached blob %s doesn't match its digest, downloading it again\n", h)
+	}
+}
+
+// verifiedBlob is a blob reader checking the blob digest and size when reaching its end
+type verifiedBlob struct {
+	rc     io.ReadCloser
+	r      io.Reader
+	hasher hash.Hash
+	n      int64
+	digest v1.Hash
+	size   int64
+	// mismatch returns the error of a blob not matching its digest
+	mismatch func(got v1.Hash, n int64) error
+	// err is the result of the verification, once the end is reached
+	err  error
+	done bool
+}
+
+// newVerifiedBlob returns a reader of rc checked against digest and size, if greater than 0
+func newVerifiedBlob(rc io.ReadCloser, digest v1.Hash, size int64, mismatch func(got v1.Hash, n int64) error) *verifiedBlob {
+	hasher := sha256.New()
+	return &verifiedBlob{rc: rc, r: io.TeeReader(rc, hasher), hasher: hasher, digest: digest, size: size, mismatch: mismatch}
+}
+
+func (b *verifiedBlob) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, b.err
+	}
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if err != io.EOF {
+		return n, err
+	}
+
+	b.done, b.err = true, io.EOF
+	got := v1.Hash{Algorithm: b.digest.Algorithm, Hex: hex.EncodeToString(b.hasher.Sum(nil))}
+	if got != b.digest || (b.size > 0 && b.n != b.size) {
+		b.err = b.mismatch(got, b.n)
+	}
+	return n, b.err
+}
+
+// Close verifies the rest of the blob if it wasn't read to its end, e.g. past the end of a tar archive
+func (b *verifiedBlob) Close() error {
+	defer b.rc.Close()
+	if !b.done {
+		if _, err := io.Copy(ioutil.Discard, b); err != nil {
+			return err
+		}
+	}
+	if b.err != io.EOF {
+		return b.err
+	}
+	return nil
+}
+
+func cached(p string, size int64) bool {
+	fi, err := os.Stat(p)
+	return err == nil && (size <= 0 || fi.Size() == size)
+}
+
+// download appends to f the blob content after what is already there, and verifies it
+func (c *BlobCache) download(f *os.File, h v1.Hash, size int64, fetch BlobFetcher) error {
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size > 0 && offset > size {
+		offset = 0
+	}
+
+	if size <= 0 || offset < size {
+		r, ranged, err := fetch(offset)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if !ranged {
+			offset = 0
+		}
+		if offset > 0 {
+			fmt.Printf("Resuming download of %s at %d/%d bytes\n", h, offset, size)
+		}
+		if err := f.Truncate(offset); err != nil {
+			return err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	got, n, err := v1.SHA256(f)
+	if err != nil {
+		return err
+	}
+	if got != h || (size > 0 && n != size) {
+		// Start over on the next attempt
+		f.Truncate(0)
+		return fmt.Errorf("downloaded blob doesn't match, got %s (%d bytes) instead of %s (%d bytes)", got, n, h, size)
+	}
+	return nil
+}
+
+// mkdirAllOwned creates dir and its missing parents, owned by the user running poco with sudo
+func mkdirAllOwned(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := mkdirAllOwned(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	chownSudoUser(dir)
+	return nil
+}
+
+// chownSudoUser gives p to the user running poco with sudo, so that the cache stays usable without it
+func chownSudoUser(p string) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	uid, err := strconv.Atoi(os.Getenv("SUDO_UID"))
+	if err != nil {
+		return
+	}
+	gid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if err != nil {
+		return
+	}
+	os.Lchown(p, uid, gid)
+}
+
+// blobFetcher returns a fetcher of the blob from the repository of ref, using range requests to resume downloads
+func (k *Bundler) blobFetcher(ref name.Reference, h v1.Hash) BlobFetcher {
+	var client *http.Client
+	return func(offset int64) (io.ReadCloser, bool, error) {
+		reg := ref.Context().Registry
+		if client == nil {
+			auth, err := k.keychain().Resolve(reg)
+			if err != nil {
+				return nil, false, err
+			}
+			t, err := k.registry.transport(reg.RegistryStr())
+			if err != nil {
+				return nil, false, err
+			}
+			rt, err := transport.NewWithContext(context.Background(), reg, auth, t, []string{ref.Context().Scope(transport.PullScope)})
+			if err != nil {
+				return nil, false, err
+			}
+			client = &http.Client{Transport: rt}
+		}
+
+		// Plain HTTP is only tried for insecure and local registries, as by the registry client
+		schemes := []string{"https"}
+		if reg.Scheme() == "http" {
+			schemes = append(schemes, "http")
+		}
+		var err error
+		for _, scheme := range schemes {
+			var req *http.Request
+			req, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s/v2/%s/blobs/%s", scheme, reg.RegistryStr(), ref.Context().RepositoryStr(), h), nil)
+			if err != nil {
+				return nil, false, err
+			}
+			if offset > 0 {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			}
+			var resp *http.Response
+			resp, err = client.Do(req)
+			if err != nil {
+				continue
+			}
+			if err := transport.CheckError(resp, http.StatusOK, http.StatusPartialContent); err != nil {
+				resp.Body.Close()
+				return nil, false, err
+			}
+			return resp.Body, resp.StatusCode == http.StatusPartialContent, nil
+		}
+		return nil, false, err
+	}
+}
+
+// wrappedImage is an image whose layers are wrapped, e.g. to read them from the blob cache
+type wrappedImage struct {
+	v1.Image
+	layer func(v1.Layer) v1.Layer
+}
+
+func (i *wrappedImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]v1.Layer, len(layers))
+	for n, l := range layers {
+		res[n] = i.layer(l)
+	}
+	return res, nil
+}
+
+func (i *wrappedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.layer(l), nil
+}
+
+// cachedLayer is a layer downloaded into the blob cache when read
+type cachedLayer struct {
+	v1.Layer
+	cache *BlobCache
+	fetch BlobFetcher
+}
+
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	h, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	size, err := l.Size()
+	if err != nil {
+		return nil, err
+	}
+	return l.cache.Open(h, size, l.fetch)
+}
+
+func (l *cachedLayer) Uncompressed() (io.ReadCloser, error) {
+	r, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return gunzip(r)
+}
+
+// gunzip decompresses r if it is gzipped
+func gunzip(r io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, r}, nil
+	}
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gr, r}, nil
+}
+
+// withCache makes the layers of the image pulled from ref go through the blob cache, if enabled
+func (k *Bundler) withCache(ref name.Reference, img v1.Image) v1.Image {
+	if k.cache == nil {
+		return img
+	}
+	return &wrappedImage{Image: img, layer: func(l v1.Layer) v1.Layer {
+		h, err := l.Digest()
+		if err != nil {
+			return l
+		}
+		return &cachedLayer{Layer: l, cache: k.cache, fetch: k.blobFetcher(ref, h)}
+	}}
+}
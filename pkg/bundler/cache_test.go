@@ -0,0 +1,137 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// testFetcher serves blob with range requests, and records the offsets requested
+type testFetcher struct {
+	blob    []byte
+	offsets []int64
+}
+
+func (f *testFetcher) fetch(offset int64) (io.ReadCloser, bool, error) {
+	f.offsets = append(f.offsets, offset)
+	return ioutil.NopCloser(bytes.NewReader(f.blob[offset:])), true, nil
+}
+
+func testBlob(t *testing.T) ([]byte, v1.Hash) {
+	t.Helper()
+	blob := bytes.Repeat([]byte("poco layer "), 1000)
+	h, _, err := v1.SHA256(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob, h
+}
+
+func readBlob(t *testing.T, c *BlobCache, h v1.Hash, size int64, f *testFetcher) []byte {
+	t.Helper()
+	r, err := c.Open(h, size, f.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dat
+}
+
+func TestBlobCacheHit(t *testing.T) {
+	blob, h := testBlob(t)
+	c := &BlobCache{Dir: t.TempDir()}
+	f := &testFetcher{blob: blob}
+
+	for i := 0; i < 2; i++ {
+		if dat := readBlob(t, c, h, int64(len(blob)), f); !bytes.Equal(dat, blob) {
+			t.Fatal("the cached blob content doesn't match")
+		}
+	}
+	if len(f.offsets) != 1 {
+		t.Fatalf("expected the blob to be fetched once, got %d fetches", len(f.offsets))
+	}
+}
+
+func TestBlobCacheResume(t *testing.T) {
+	blob, h := testBlob(t)
+	c := &BlobCache{Dir: t.TempDir()}
+	f := &testFetcher{blob: blob}
+
+	// An interrupted download
+	if err := os.MkdirAll(filepath.Dir(c.Path(h)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.Path(h)+".partial", blob[:1000], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if dat := readBlob(t, c, h, int64(len(blob)), f); !bytes.Equal(dat, blob) {
+		t.Fatal("the resumed blob content doesn't match")
+	}
+	if len(f.offsets) != 1 || f.offsets[0] != 1000 {
+		t.Fatalf("expected the download to resume at 1000, got offsets %v", f.offsets)
+	}
+}
+
+func TestBlobCacheCorrupt(t *testing.T) {
+	blob, h := testBlob(t)
+	c := &BlobCache{Dir: t.TempDir()}
+	f := &testFetcher{blob: blob}
+
+	// A cached blob with the right size but another content is downloaded again
+	if err := os.MkdirAll(filepath.Dir(c.Path(h)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.Path(h), bytes.Repeat([]byte("x"), len(blob)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if dat := readBlob(t, c, h, int64(len(blob)), f); !bytes.Equal(dat, blob) {
+		t.Fatal("the corrupted blob was not downloaded again")
+	}
+	if len(f.offsets) != 1 {
+		t.Fatalf("expected the blob to be fetched again, got %d fetches", len(f.offsets))
+	}
+
+	// A blob modified while it is read fails the read, and is evicted
+	r, err := c.Open(h, int64(len(blob)), f.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := ioutil.WriteFile(c.Path(h), bytes.Repeat([]byte("x"), len(blob)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Fatalf("expected the read of the modified blob to fail, got %v", err)
+	}
+	if _, err := os.Stat(c.Path(h)); !os.IsNotExist(err) {
+		t.Fatal("expected the modified blob to be removed from the cache")
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FilterPresets are named sets of exclude rules for content rarely needed at runtime
+var FilterPresets = map[string][]string{
+	"docs": {
+		"/usr/share/doc", "/usr/share/man", "/usr/share/info", "/usr/share/gtk-doc",
+		"/usr/local/share/doc", "/usr/local/share/man",
+	},
+	"locales": {
+		"/usr/share/locale", "/usr/share/i18n", "/usr/local/share/locale",
+	},
+	"pkg-caches": {
+		"/var/cache/apk", "/var/cache/apt", "/var/lib/apt/lists", "/var/cache/dnf", "/var/cache/yum",
+		"/var/cache/pacman/pkg", "/var/cache/zypp", "/var/cache/luet",
+	},
+	"headers": {
+		"/usr/include", "/usr/local/include",
+	},
+}
+
+// PresetNames returns the names of the filter presets
+func PresetNames() []string {
+	var names []string
+	for n := range FilterPresets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Filter selects the files of a rootfs to drop from the bundle.
+// Rules are globs: absolute ones (e.g. /usr/share/man/*) match a path and everything below it,
+// the others (e.g. *.a) match the file or directory name anywhere. Exclude rules can also be preset names.
+// Paths matching an include rule are kept, even if excluded.
+type Filter struct {
+	Exclude []string
+	Include []string
+}
+
+// Empty returns true if the filter keeps every file
+func (f Filter) Empty() bool {
+	return len(f.Exclude) == 0
+}
+
+// Flags returns the poco flags setting the filter
+func (f Filter) Flags() []string {
+	var res []string
+	for _, e := range f.Exclude {
+		res = append(res, "--exclude", fmt.Sprintf("%q", e))
+	}
+	for _, i := range f.Include {
+		res = append(res, "--include", fmt.Sprintf("%q", i))
+	}
+	return res
+}
+
+// rules returns the exclude rules, with the presets expanded
+func (f Filter) rules() []string {
+	var res []string
+	for _, e := range f.Exclude {
+		if p, ok := FilterPresets[e]; ok {
+			res = append(res, p...)
+		} else {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Validate checks the filter rules
+func (f Filter) Validate() error {
+	for _, r := range append(f.rules(), f.Include...) {
+		if r == "" || r == "/" {
+			return fmt.Errorf("invalid filter rule '%s'", r)
+		}
+		if _, err := path.Match(r, ""); err != nil {
+			return errors.Wrapf(err, "invalid filter rule '%s'", r)
+		}
+	}
+	return nil
+}
+
+// WithFilter sets the rules dropping files from the bundled rootfs
+func WithFilter(f Filter) Option {
+	return func(k *Bundler) error {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+		k.filter = f
+		return nil
+	}
+}
+
+// matchRule returns true if the rule matches p (a clean absolute path) or one of its parents
+func matchRule(rule, p string) bool {
+	segments := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if !path.IsAbs(rule) {
+		for _, s := range segments {
+			if ok, _ := path.Match(rule, s); ok {
+				return true
+			}
+		}
+		return false
+	}
+	ruleSegments := strings.Split(strings.Trim(path.Clean(rule), "/"), "/")
+	if len(segments) < len(ruleSegments) {
+		return false
+	}
+	for i, r := range ruleSegments {
+		if ok, _ := path.Match(r, segments[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// mayContain returns true if the rule can match a path below the directory dir
+func mayContain(rule, dir string) bool {
+	if !path.IsAbs(rule) {
+		return true
+	}
+	segments := strings.Split(strings.TrimPrefix(dir, "/"), "/")
+	ruleSegments := strings.Split(strings.Trim(path.Clean(rule), "/"), "/")
+	for i, s := range segments {
+		if i >= len(ruleSegments) {
+			return true
+		}
+		if ok, _ := path.Match(ruleSegments[i], s); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(rules []string, p string) bool {
+	for _, r := range rules {
+		if matchRule(r, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterRootfs removes from rootfs the files excluded by the filter.
+// It returns the number of files removed and their size.
+func FilterRootfs(rootfs string, f Filter) (files int, size int64, err error) {
+	if err := f.Validate(); err != nil {
+		return 0, 0, err
+	}
+	excludes := f.rules()
+
+	// count returns the files and size under p, before removing it
+	count := func(p string) error {
+		return filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			files++
+			if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+
+	err = filepath.WalkDir(rootfs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = "/" + filepath.ToSlash(rel)
+		if !matchAny(excludes, rel) || matchAny(f.Include, rel) {
+			return nil
+		}
+
+		// Keep descending into the directories which may hold included files
+		if d.IsDir() {
+			for _, i := range f.Include {
+				if mayContain(i, rel) {
+					return nil
+				}
+			}
+		}
+		if err := count(p); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return files, size, err
+}
@@ -0,0 +1,175 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Lock pins the images of a bundle to their digests
+type Lock struct {
+	Images []LockedImage `yaml:"images"`
+}
+
+// LockedImage is an image reference resolved to a digest
+type LockedImage struct {
+	Image    string `yaml:"image"`
+	Platform string `yaml:"platform"`
+	// Digest is what the reference resolves to, either an index or a manifest
+	Digest string `yaml:"digest"`
+	// Manifest is the digest of the manifest for the platform
+	Manifest string `yaml:"manifest"`
+}
+
+// WithLockFile sets the lock file pinning the images to their digests.
+// If update is false, the build fails when an image resolves to a different digest than the locked one.
+func WithLockFile(file string, update bool) Option {
+	return func(k *Bundler) error {
+		k.lockFile = file
+		k.updateLock = update
+		return nil
+	}
+}
+
+// LoadLock reads a lock file. A missing lock file is empty.
+func LoadLock(file string) (*Lock, error) {
+	l := &Lock{}
+	dat, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(dat, l); err != nil {
+		return nil, errors.Wrapf(err, "invalid lock file '%s'", file)
+	}
+	return l, nil
+}
+
+// Save writes the lock file
+func (l *Lock) Save(file string) error {
+	dat, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append([]byte("# Generated by poco, pins the bundled images to their digests\n"), dat...), 0644)
+}
+
+func (l *Lock) find(image, platform string) *LockedImage {
+	for i := range l.Images {
+		if l.Images[i].Image == image && l.Images[i].Platform == platform {
+			return &l.Images[i]
+		}
+	}
+	return nil
+}
+
+// prune removes the entries of the images not in refs
+func (l *Lock) prune(refs []string) {
+	var images []LockedImage
+	for _, i := range l.Images {
+		if contains(refs, i.Image) {
+			images = append(images, i)
+		}
+	}
+	l.Images = images
+}
+
+// resolveDigest returns the digest the registry image reference resolves to, and the digest of its manifest for the bundler platform
+func (k *Bundler) resolveDigest(image string) (digest string, manifest string, err error) {
+	err = k.withMirror(image, func(ref name.Reference, opts []remote.Option) error {
+		desc, err := remote.Get(ref, opts...)
+		if err != nil {
+			return err
+		}
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		m, err := img.Digest()
+		if err != nil {
+			return err
+		}
+		digest, manifest = desc.Digest.String(), m.String()
+		return nil
+	})
+	return digest, manifest, err
+}
+
+// lock resolves the registry images to their digests, checks them against the lock file and updates it.
+// The entries of images no longer bundled are removed from the lock file.
+// It returns the images pinned to the digests, which select the locked manifest for the platform.
+func (k *Bundler) lock(images []string) ([]string, error) {
+	l, err := LoadLock(k.lockFile)
+	if err != nil {
+		return nil, err
+	}
+
+	platform := platformString(k.Platform())
+	var res, refs []string
+	for _, image := range images {
+		transport, ref := k.SplitTransport(image)
+		if transport != TransportRegistry {
+			res = append(res, image)
+			continue
+		}
+		ref = strings.TrimPrefix(ref, "//")
+		refs = append(refs, ref)
+
+		digest, manifest, err := k.resolveDigest(ref)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failure while resolving the digest of '%s'", ref)
+		}
+
+		locked := l.find(ref, platform)
+		switch {
+		case locked == nil:
+			l.Images = append(l.Images, LockedImage{Image: ref, Platform: platform, Digest: digest, Manifest: manifest})
+		case locked.Digest != digest && !k.updateLock:
+			return nil, fmt.Errorf("image '%s' (%s) now resolves to %s, while it is locked to %s in '%s'. Use --update-lock to bundle it",
+				ref, platform, digest, locked.Digest, k.lockFile)
+		default:
+			if locked.Digest != digest {
+				fmt.Printf("Updating '%s' (%s) lock from %s to %s\n", ref, platform, locked.Digest, digest)
+			}
+			locked.Digest = digest
+			locked.Manifest = manifest
+		}
+
+		pinned, err := k.registry.ParseReference(ref)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, pinned.Context().Name()+"@"+digest)
+	}
+
+	if len(refs) == 0 {
+		return res, nil
+	}
+	l.prune(refs)
+	if err := l.Save(k.lockFile); err != nil {
+		return nil, errors.Wrapf(err, "failure while writing lock file '%s'", k.lockFile)
+	}
+	return res, nil
+}
@@ -0,0 +1,193 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/mudler/poco/pkg/extractor"
+	"github.com/pkg/errors"
+)
+
+// WithMinimize makes the bundle contain only the entrypoint, the app commands,
+// the keep paths and what they need to run
+func WithMinimize(keep ...string) Option {
+	return func(k *Bundler) error {
+		for _, p := range keep {
+			if !path.IsAbs(p) {
+				return fmt.Errorf("invalid keep path '%s', it must be absolute", p)
+			}
+		}
+		k.minimize = true
+		k.keep = keep
+		return nil
+	}
+}
+
+// Binaries returns the entrypoint and the commands of the app
+func (a App) Binaries() []string {
+	res := []string{a.Entrypoint}
+	for _, n := range a.CommandNames() {
+		res = append(res, a.Commands[n])
+	}
+	return res
+}
+
+// lookPath resolves a command in the rootfs PATH, if it is not absolute
+func lookPath(rootfs, cmd string) string {
+	if path.IsAbs(cmd) {
+		return cmd
+	}
+	for _, d := range []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"} {
+		if _, err := os.Stat(filepath.Join(rootfs, d, cmd)); err == nil {
+			return path.Join(d, cmd)
+		}
+	}
+	return cmd
+}
+
+// dangling returns true if the symlink p doesn't lead to a file inside rootfs
+func dangling(rootfs, p string) bool {
+	target, err := securejoin.SecureJoin(rootfs, p)
+	if err != nil {
+		return true
+	}
+	_, err = os.Lstat(target)
+	return err != nil
+}
+
+// Minimize removes from rootfs the files not needed by the entrypoints and the keep paths:
+// the files, the libraries they load and the symlinks leading to them are kept, along with
+// everything below the keep directories and the empty directories. The keep paths can be globs.
+// It returns the paths removed, and the number and size of the files removed.
+func Minimize(rootfs string, entrypoints, keep []string) (removed []string, files int, size int64, err error) {
+	var roots []string
+	for _, e := range entrypoints {
+		if e != "" {
+			roots = append(roots, lookPath(rootfs, e))
+		}
+	}
+
+	// The regular files below the keep paths are analyzed too, for their libraries.
+	// The other files, e.g. symlinks dangling outside of the rootfs as /etc/mtab, are kept as they are.
+	keepDirs := map[string]bool{}
+	var keepFiles []string
+	for _, k := range keep {
+		matches, err := filepath.Glob(filepath.Join(rootfs, k))
+		if err != nil {
+			return nil, 0, 0, errors.Wrapf(err, "invalid keep path '%s'", k)
+		}
+		if len(matches) == 0 {
+			fmt.Fprintf(os.Stderr, "Warning: keep path '%s' not found in the rootfs\n", k)
+		}
+		for _, m := range matches {
+			err := filepath.WalkDir(m, func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(rootfs, p)
+				if err != nil {
+					return err
+				}
+				rel = path.Join("/", filepath.ToSlash(rel))
+				switch {
+				case d.IsDir():
+					if p == m {
+						keepDirs[rel] = true
+					}
+				case d.Type().IsRegular():
+					roots = append(roots, rel)
+				case d.Type()&fs.ModeSymlink != 0 && !dangling(rootfs, rel):
+					roots = append(roots, rel)
+				default:
+					keepFiles = append(keepFiles, rel)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, 0, 0, err
+			}
+		}
+	}
+
+	deps, err := extractor.Dependencies(extractor.WithRoot(rootfs), extractor.WithFiles(roots...))
+	if err != nil {
+		return nil, 0, 0, errors.Wrap(err, "failure while resolving the dependencies in the rootfs")
+	}
+
+	// Keep the needed files and their parent directories
+	kept := map[string]bool{"/": true}
+	for _, d := range append(deps, keepFiles...) {
+		for p := d; !kept[p]; p = path.Dir(p) {
+			kept[p] = true
+		}
+	}
+
+	err = filepath.WalkDir(rootfs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, p)
+		if err != nil {
+			return err
+		}
+		rel = path.Join("/", filepath.ToSlash(rel))
+		if keepDirs[rel] {
+			return filepath.SkipDir
+		}
+		if kept[rel] {
+			return nil
+		}
+
+		before := files
+		err = filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			files++
+			if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Empty directories are kept, e.g. as mountpoints
+		if d.IsDir() && files == before {
+			return filepath.SkipDir
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		removed = append(removed, rel)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	sort.Strings(removed)
+	return removed, files, size, err
+}
@@ -0,0 +1,73 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTree creates the files of a rootfs: contents of regular files, or symlink targets prefixed by "->"
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for p, content := range files {
+		full := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if len(content) > 2 && content[:2] == "->" {
+			err = os.Symlink(content[2:], full)
+		} else {
+			err = ioutil.WriteFile(full, []byte(content), 0755)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMinimizeDanglingSymlink(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"bin/app":              "data",
+		"etc/hosts":            "127.0.0.1 localhost",
+		"etc/mtab":             "->../proc/self/mounts",
+		"etc/alternatives/foo": "->/usr/bin/foo",
+		"usr/bin/foo":          "foo",
+		"usr/share/junk":       "junk",
+	})
+	os.MkdirAll(filepath.Join(root, "proc"), 0755)
+
+	removed, files, _, err := Minimize(root, []string{"/bin/app"}, []string{"/etc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "/usr/share" || files != 1 {
+		t.Fatalf("expected only /usr/share to be removed, got %v (%d files)", removed, files)
+	}
+
+	if target, err := os.Readlink(filepath.Join(root, "etc/mtab")); err != nil || target != "../proc/self/mounts" {
+		t.Fatalf("expected the dangling symlink to be kept as is, got %s (%v)", target, err)
+	}
+	for _, p := range []string{"bin/app", "etc/hosts", "usr/bin/foo", "proc"} {
+		if _, err := os.Lstat(filepath.Join(root, p)); err != nil {
+			t.Fatalf("expected %s to be kept: %v", p, err)
+		}
+	}
+}
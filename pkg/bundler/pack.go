@@ -0,0 +1,475 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+// ImageConfig is the runtime configuration of the images created by pack
+type ImageConfig struct {
+	Entrypoint   []string
+	Cmd          []string
+	Env          []string
+	WorkingDir   string
+	User         string
+	Labels       map[string]string
+	ExposedPorts []string
+}
+
+// ParseCommand parses an entrypoint or a command, either as a JSON array
+// (e.g. ["/bin/app", "--flag"]) or as whitespace separated arguments.
+// It returns nil if s is empty, and an empty command for an empty array.
+func ParseCommand(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(s, "[") {
+		return strings.Fields(s), nil
+	}
+	var res []string
+	if err := json.Unmarshal([]byte(s), &res); err != nil {
+		return nil, errors.Wrapf(err, "invalid command '%s', it must be a JSON array of strings", s)
+	}
+	return res, nil
+}
+
+// validateEnv checks environment variables are in the KEY=VALUE form
+func validateEnv(env []string) error {
+	for _, e := range env {
+		if strings.Index(e, "=") <= 0 {
+			return fmt.Errorf("invalid environment variable '%s', it must be in the form KEY=VALUE", e)
+		}
+	}
+	return nil
+}
+
+// ParseLabels parses labels in the key=value form
+func ParseLabels(labels []string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, l := range labels {
+		dat := strings.SplitN(l, "=", 2)
+		if len(dat) != 2 || dat[0] == "" {
+			return nil, fmt.Errorf("invalid label '%s', it must be in the form key=value", l)
+		}
+		res[dat[0]] = dat[1]
+	}
+	return res, nil
+}
+
+// ParsePort parses an exposed port in the port[/protocol] form, tcp being the default protocol
+func ParsePort(s string) (string, error) {
+	dat := strings.SplitN(s, "/", 2)
+	proto := "tcp"
+	if len(dat) == 2 {
+		proto = strings.ToLower(dat[1])
+	}
+	port, err := strconv.Atoi(dat[0])
+	if err != nil || port < 1 || port > 65535 || !contains([]string{"tcp", "udp", "sctp"}, proto) {
+		return "", fmt.Errorf("invalid port '%s', it must be in the form port[/tcp|udp|sctp]", s)
+	}
+	return fmt.Sprintf("%d/%s", port, proto), nil
+}
+
+// Validate checks the image config values
+func (c ImageConfig) Validate() error {
+	if err := validateEnv(c.Env); err != nil {
+		return err
+	}
+	for _, p := range c.ExposedPorts {
+		if _, err := ParsePort(p); err != nil {
+			return err
+		}
+	}
+	if c.WorkingDir != "" && !path.IsAbs(c.WorkingDir) {
+		return fmt.Errorf("invalid working directory '%s', it must be absolute", c.WorkingDir)
+	}
+	return nil
+}
+
+// apply sets the image config values in cfg, on top of the base image ones: the environment
+// variables, labels and exposed ports are merged, the other values are replaced if set.
+// As with Dockerfiles, setting the entrypoint resets the base image command.
+func (c ImageConfig) apply(cfg *v1.ConfigFile) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if c.Entrypoint != nil {
+		cfg.Config.Entrypoint = c.Entrypoint
+		cfg.Config.Cmd = nil
+	}
+	if c.Cmd != nil {
+		cfg.Config.Cmd = c.Cmd
+	}
+	for _, e := range c.Env {
+		cfg.Config.Env = setEnv(cfg.Config.Env, e)
+	}
+	if c.WorkingDir != "" {
+		cfg.Config.WorkingDir = c.WorkingDir
+	}
+	if c.User != "" {
+		cfg.Config.User = c.User
+	}
+	for k, v := range c.Labels {
+		if cfg.Config.Labels == nil {
+			cfg.Config.Labels = map[string]string{}
+		}
+		cfg.Config.Labels[k] = v
+	}
+	for _, p := range c.ExposedPorts {
+		port, _ := ParsePort(p)
+		if cfg.Config.ExposedPorts == nil {
+			cfg.Config.ExposedPorts = map[string]struct{}{}
+		}
+		cfg.Config.ExposedPorts[port] = struct{}{}
+	}
+	return nil
+}
+
+// setEnv sets the KEY=VALUE variable e in env, replacing the variable with the same key
+func setEnv(env []string, e string) []string {
+	key := strings.SplitN(e, "=", 2)[0]
+	for i, v := range env {
+		if strings.SplitN(v, "=", 2)[0] == key {
+			res := append([]string{}, env...)
+			res[i] = e
+			return res
+		}
+	}
+	return append(env, e)
+}
+
+// Formats of the images written by pack
+const (
+	DockerArchive = "docker-archive"
+	OCILayout     = "oci-layout"
+)
+
+// PackFormats are the formats pack can write images in
+var PackFormats = []string{DockerArchive, OCILayout}
+
+// ociRefName is the annotation tagging the images of an OCI layout
+const ociRefName = "org.opencontainers.image.ref.name"
+
+// PackOutput sets where pack writes the image: to Destination in Format, to its registry with Push, or both
+type PackOutput struct {
+	Destination string
+	Format      string
+	Push        bool
+}
+
+// Validate checks the output has a known format and goes somewhere
+func (o PackOutput) Validate() error {
+	if o.Format == "" {
+		if !o.Push {
+			return errors.New("no output for the image, specify a format or push it")
+		}
+		return nil
+	}
+	if !contains(PackFormats, o.Format) {
+		return fmt.Errorf("unknown format '%s', available formats: %s", o.Format, strings.Join(PackFormats, ", "))
+	}
+	if o.Destination == "" {
+		return fmt.Errorf("no destination for the %s output", o.Format)
+	}
+	return nil
+}
+
+// PackLayers sets how the sources are layered in the images created by pack
+type PackLayers struct {
+	// Base is the image the layers are appended to, whose config is kept unless overridden.
+	// The image is created from scratch if empty.
+	Base string
+	// PerSource creates a layer per source, in place of a single layer
+	PerSource bool
+}
+
+// packImage creates an image for the platform with the sources as its layers, configured with config.
+// The layers are archived in dir, which must be kept until the image is written.
+func (k *Bundler) packImage(dir string, sources []string, platform v1.Platform, layers PackLayers, config ImageConfig, format string) (v1.Image, error) {
+	groups := [][]string{sources}
+	if layers.PerSource {
+		groups = nil
+		for _, s := range sources {
+			groups = append(groups, []string{s})
+		}
+	}
+
+	var img v1.Image
+	var layerType types.MediaType
+	if layers.Base != "" {
+		var err error
+		if img, err = k.platformImage(layers.Base, platform); err != nil {
+			return nil, errors.Wrapf(err, "failure while retrieving the base image '%s'", layers.Base)
+		}
+		// The layers get the media types of the base image ones
+		mt, err := img.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		if mt == types.OCIManifestSchema1 {
+			layerType = types.OCILayer
+		}
+	} else {
+		cfg, err := empty.Image.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		cfg.OS = platform.OS
+		cfg.Architecture = platform.Architecture
+		if img, err = mutate.ConfigFile(empty.Image, cfg); err != nil {
+			return nil, err
+		}
+		// OCI layouts get OCI media types, the Docker ones are kept otherwise for compatibility
+		if format == OCILayout {
+			img = mutate.ConfigMediaType(mutate.MediaType(img, types.OCIManifestSchema1), types.OCIConfigJSON)
+			layerType = types.OCILayer
+		}
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+	if err := config.apply(cfg); err != nil {
+		return nil, err
+	}
+	if img, err = mutate.ConfigFile(img, cfg); err != nil {
+		return nil, err
+	}
+
+	for i, g := range groups {
+		archive := filepath.Join(dir, fmt.Sprintf("layer-%d.tar", i))
+		if err := PackAssets(g, archive); err != nil {
+			return nil, errors.Wrap(err, "failure while archiving the sources")
+		}
+		layer, err := tarball.LayerFromFile(archive)
+		if err != nil {
+			return nil, err
+		}
+		img, err = mutate.Append(img, mutate.Addendum{
+			Layer:     layer,
+			MediaType: layerType,
+			History: v1.History{
+				CreatedBy: "poco pack " + strings.Join(g, " "),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// platformImage returns the image for the platform, checking it matches
+func (k *Bundler) platformImage(image string, platform v1.Platform) (v1.Image, error) {
+	prev := k.platform
+	k.platform = &platform
+	defer func() { k.platform = prev }()
+
+	img, err := k.Image(image)
+	if err != nil {
+		return nil, err
+	}
+	return img, k.verifyPlatform(img)
+}
+
+// writeImage writes the image, or the index of the images of several platforms, tagged as ref to the pack output
+func (k *Bundler) writeImage(ref name.Reference, add mutate.Appendable, out PackOutput) error {
+	switch out.Format {
+	case DockerArchive:
+		img, ok := add.(v1.Image)
+		if !ok {
+			return fmt.Errorf("the %s format can't hold an image index", DockerArchive)
+		}
+		if err := tarball.WriteToFile(out.Destination, ref, img); err != nil {
+			return errors.Wrapf(err, "failure while writing '%s'", out.Destination)
+		}
+	case OCILayout:
+		if err := writeLayout(out.Destination, ref, add); err != nil {
+			return errors.Wrapf(err, "failure while writing the OCI layout '%s'", out.Destination)
+		}
+	}
+
+	if out.Push {
+		opts, err := k.RemoteOptions(ref)
+		if err != nil {
+			return err
+		}
+		switch t := add.(type) {
+		case v1.ImageIndex:
+			err = remote.WriteIndex(ref, t, opts...)
+		case v1.Image:
+			err = remote.Write(ref, t, opts...)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failure while pushing '%s'", ref)
+		}
+		d, err := add.Digest()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Pushed %s@%s\n", ref.Context(), d)
+	}
+	return nil
+}
+
+// writeLayout adds the image or index to the OCI layout at dst, created if missing,
+// tagged with its ref tag and in place of the one previously tagged the same
+func writeLayout(dst string, ref name.Reference, add mutate.Appendable) error {
+	p, err := layout.FromPath(dst)
+	if err != nil {
+		if p, err = layout.Write(dst, empty.Index); err != nil {
+			return err
+		}
+	}
+	tag := ref.Identifier()
+	matcher := match.Annotation(ociRefName, tag)
+	annotations := layout.WithAnnotations(map[string]string{ociRefName: tag})
+	if idx, ok := add.(v1.ImageIndex); ok {
+		return p.ReplaceIndex(idx, matcher, annotations)
+	}
+	return p.ReplaceImage(add.(v1.Image), matcher, annotations)
+}
+
+// Pack creates an image tagged as image, for the platform with the sources as its layers,
+// and writes it to the output
+func (k *Bundler) Pack(image string, sources []string, platform v1.Platform, layers PackLayers, config ImageConfig, out PackOutput) error {
+	if err := out.Validate(); err != nil {
+		return err
+	}
+	ref, err := k.registry.ParseReference(image)
+	if err != nil {
+		return err
+	}
+	if err := k.authorize(image); err != nil {
+		return err
+	}
+	if err := k.authorize(layers.Base); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "poco-pack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	img, err := k.packImage(dir, sources, platform, layers, config, out.Format)
+	if err != nil {
+		return err
+	}
+	return k.writeImage(ref, img, out)
+}
+
+// PlatformSources are the sources of the image of a platform in a multi-platform image
+type PlatformSources struct {
+	Platform v1.Platform
+	Sources  []string
+}
+
+// ParsePlatformSource parses the source of a platform image in the os/arch[/variant]=dir form
+func ParsePlatformSource(s string) (*v1.Platform, string, error) {
+	dat := strings.SplitN(s, "=", 2)
+	if len(dat) != 2 || dat[1] == "" {
+		return nil, "", fmt.Errorf("invalid platform source '%s', it must be in the form os/arch[/variant]=dir", s)
+	}
+	p, err := ParsePlatform(dat[0])
+	if err != nil {
+		return nil, "", err
+	}
+	return p, dat[1], nil
+}
+
+// PackIndex creates an image for each platform with its sources as layers, and writes
+// the index of the images tagged as image to the output. The index can't be written as docker-archive.
+func (k *Bundler) PackIndex(image string, platforms []PlatformSources, layers PackLayers, config ImageConfig, out PackOutput) error {
+	if err := out.Validate(); err != nil {
+		return err
+	}
+	if out.Format == DockerArchive {
+		return fmt.Errorf("multi-platform images can't be written as %s, push them or write them as %s", DockerArchive, OCILayout)
+	}
+	if len(platforms) == 0 {
+		return errors.New("no platform to pack")
+	}
+	ref, err := k.registry.ParseReference(image)
+	if err != nil {
+		return err
+	}
+	if err := k.authorize(image); err != nil {
+		return err
+	}
+	if err := k.authorize(layers.Base); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "poco-pack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// The index media type follows the manifests ones: an OCI index holds the OCI manifests,
+	// created for OCI layouts or from OCI base images, a Docker manifest list the Docker ones
+	var idx v1.ImageIndex = empty.Index
+	indexType := types.DockerManifestList
+	seen := map[string]bool{}
+	for i, p := range platforms {
+		platform := platformString(p.Platform)
+		if seen[platform] {
+			return fmt.Errorf("platform '%s' given multiple times", platform)
+		}
+		seen[platform] = true
+
+		imgDir := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.Mkdir(imgDir, 0700); err != nil {
+			return err
+		}
+		img, err := k.packImage(imgDir, p.Sources, p.Platform, layers, config, out.Format)
+		if err != nil {
+			return errors.Wrapf(err, "failure while packing the %s image", platform)
+		}
+		desc, err := partial.Descriptor(img)
+		if err != nil {
+			return err
+		}
+		desc.Platform = &v1.Platform{OS: p.Platform.OS, Architecture: p.Platform.Architecture, Variant: p.Platform.Variant}
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{Add: img, Descriptor: *desc})
+		if desc.MediaType == types.OCIManifestSchema1 {
+			indexType = types.OCIImageIndex
+		}
+	}
+	return k.writeImage(ref, mutate.IndexMediaType(idx, indexType), out)
+}
@@ -0,0 +1,432 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+var testPlatform = v1.Platform{OS: "linux", Architecture: "amd64"}
+
+func TestParseCommand(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{in: "", want: nil},
+		{in: "  ", want: nil},
+		{in: "/bin/app --flag  value", want: []string{"/bin/app", "--flag", "value"}},
+		{in: `["/bin/app", "a b"]`, want: []string{"/bin/app", "a b"}},
+		{in: "[]", want: []string{}},
+		{in: `["/bin/app", 1]`, err: true},
+		{in: `["/bin/app"`, err: true},
+	} {
+		got, err := ParseCommand(tc.in)
+		if (err != nil) != tc.err {
+			t.Fatalf("ParseCommand(%q): unexpected error %v", tc.in, err)
+		}
+		if !tc.err && !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("ParseCommand(%q) = %#v, expected %#v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"80", "80/tcp"},
+		{"53/UDP", "53/udp"},
+		{"9000/sctp", "9000/sctp"},
+		{"65535/tcp", "65535/tcp"},
+		{"0", ""},
+		{"65536", ""},
+		{"http", ""},
+		{"80/icmp", ""},
+		{"", ""},
+	} {
+		got, err := ParsePort(tc.in)
+		if tc.want == "" {
+			if err == nil {
+				t.Fatalf("expected ParsePort(%q) to fail, got %s", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Fatalf("ParsePort(%q) = %s (%v), expected %s", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	env := []string{"PATH=/bin", "HOME=/root"}
+
+	got := setEnv(env, "PATH=/usr/bin:/bin")
+	if want := []string{"PATH=/usr/bin:/bin", "HOME=/root"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if env[0] != "PATH=/bin" {
+		t.Fatal("expected the base environment not to be modified")
+	}
+
+	got = setEnv(env, "LANG=C.UTF-8")
+	if want := []string{"PATH=/bin", "HOME=/root", "LANG=C.UTF-8"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	// A variable prefixed by another one's key is another variable
+	got = setEnv(env, "PATHS=/opt")
+	if len(got) != 3 {
+		t.Fatalf("expected PATHS to be added, got %v", got)
+	}
+}
+
+func TestImageConfigApply(t *testing.T) {
+	cfg := &v1.ConfigFile{Config: v1.Config{
+		Entrypoint: []string{"/bin/sh"},
+		Cmd:        []string{"-c", "true"},
+		Env:        []string{"PATH=/bin"},
+		Labels:     map[string]string{"a": "1"},
+	}}
+	err := ImageConfig{
+		Entrypoint:   []string{"/bin/app"},
+		Env:          []string{"PATH=/app/bin", "DEBUG=1"},
+		Labels:       map[string]string{"b": "2"},
+		ExposedPorts: []string{"8080"},
+	}.apply(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Config.Entrypoint, []string{"/bin/app"}) || cfg.Config.Cmd != nil {
+		t.Fatalf("expected the entrypoint to be set and the command reset, got %v %v", cfg.Config.Entrypoint, cfg.Config.Cmd)
+	}
+	if !reflect.DeepEqual(cfg.Config.Env, []string{"PATH=/app/bin", "DEBUG=1"}) {
+		t.Fatalf("unexpected environment %v", cfg.Config.Env)
+	}
+	if len(cfg.Config.Labels) != 2 {
+		t.Fatalf("expected the labels to be merged, got %v", cfg.Config.Labels)
+	}
+	if _, ok := cfg.Config.ExposedPorts["8080/tcp"]; !ok {
+		t.Fatalf("expected 8080/tcp to be exposed, got %v", cfg.Config.ExposedPorts)
+	}
+
+	for _, c := range []ImageConfig{
+		{Env: []string{"NOVALUE"}},
+		{WorkingDir: "relative"},
+		{ExposedPorts: []string{"80/icmp"}},
+	} {
+		if err := c.apply(&v1.ConfigFile{}); err == nil {
+			t.Fatalf("expected %+v to be invalid", c)
+		}
+	}
+}
+
+// imageFiles returns the content of the regular files in the layers of img
+func imageFiles(t *testing.T, img v1.Image) map[string]string {
+	t.Helper()
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := map[string]string{}
+	for _, l := range layers {
+		r, err := l.Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				dat, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res[filepath.Clean(hdr.Name)] = string(dat)
+			}
+		}
+		r.Close()
+	}
+	return res
+}
+
+func TestPackLayout(t *testing.T) {
+	k, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "layout")
+	out := PackOutput{Destination: dst, Format: OCILayout}
+
+	for _, p := range []struct{ tag, content string }{{"app:v1", "first"}, {"app:v2", "other"}, {"app:v1", "second"}} {
+		src := t.TempDir()
+		writeTree(t, src, map[string]string{"app/data": p.content})
+		if err := k.Pack(p.tag, []string{filepath.Join(src, "app")}, testPlatform, PackLayers{}, ImageConfig{}, out); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Packing again with the same tag replaces the image
+	idx, err := layout.ImageIndexFromPath(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Manifests) != 2 {
+		t.Fatalf("expected 2 images in the layout, got %d", len(m.Manifests))
+	}
+
+	for tag, content := range map[string]string{"v1": "second", "v2": "other"} {
+		img, err := k.Image(TransportOCI + ":" + dst + ":" + tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mt, err := img.MediaType()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt != types.OCIManifestSchema1 {
+			t.Fatalf("expected an OCI manifest, got %s", mt)
+		}
+		if files := imageFiles(t, img); files["app/data"] != content {
+			t.Fatalf("expected app/data of %s to be %q, got %v", tag, content, files)
+		}
+	}
+}
+
+func TestPackPush(t *testing.T) {
+	host := testRegistry(t)
+	k, err := New(WithRegistryConfig(RegistryConfig{Insecure: []string{host}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"app/data": "pushed"})
+
+	config := ImageConfig{Entrypoint: []string{"/app/data"}}
+	if err := k.Pack(host+"/app:v1", []string{filepath.Join(src, "app")}, testPlatform, PackLayers{}, config, PackOutput{Push: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := name.ParseReference(host+"/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.OS != "linux" || cfg.Architecture != "amd64" || !reflect.DeepEqual(cfg.Config.Entrypoint, config.Entrypoint) {
+		t.Fatalf("unexpected config of the pushed image: %+v", cfg)
+	}
+	if files := imageFiles(t, img); files["app/data"] != "pushed" {
+		t.Fatalf("unexpected content of the pushed image: %v", files)
+	}
+}
+
+func TestPackIndex(t *testing.T) {
+	host := testRegistry(t)
+	k, err := New(WithRegistryConfig(RegistryConfig{Insecure: []string{host}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd64, arm64 := t.TempDir(), t.TempDir()
+	writeTree(t, amd64, map[string]string{"app": "amd64"})
+	writeTree(t, arm64, map[string]string{"app": "arm64"})
+	platforms := []PlatformSources{
+		{Platform: testPlatform, Sources: []string{amd64 + "/."}},
+		{Platform: v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, Sources: []string{arm64 + "/."}},
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, tc := range []struct {
+			name      string
+			platforms []PlatformSources
+			out       PackOutput
+			err       string
+		}{
+			{"docker-archive", platforms, PackOutput{Destination: filepath.Join(t.TempDir(), "app.tar"), Format: DockerArchive}, "can't be written as docker-archive"},
+			{"duplicate platform", append(platforms, platforms[0]), PackOutput{Push: true}, "given multiple times"},
+			{"no platform", nil, PackOutput{Push: true}, "no platform"},
+		} {
+			err := k.PackIndex(host+"/invalid:v1", tc.platforms, PackLayers{}, ImageConfig{}, tc.out)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("%s: expected packing the index to fail with %q, got %v", tc.name, tc.err, err)
+			}
+		}
+		// Nothing is pushed
+		ref, _ := name.ParseReference(host+"/invalid:v1", name.Insecure)
+		if _, err := remote.Head(ref); err == nil {
+			t.Fatal("expected the invalid index not to be pushed")
+		}
+	})
+
+	t.Run("push", func(t *testing.T) {
+		if err := k.PackIndex(host+"/app:v1", platforms, PackLayers{}, ImageConfig{}, PackOutput{Push: true}); err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.ParseReference(host+"/app:v1", name.Insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := remote.Index(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := idx.IndexManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.MediaType != types.DockerManifestList || len(m.Manifests) != 2 {
+			t.Fatalf("expected a Docker manifest list of 2 images, got %s with %d images", m.MediaType, len(m.Manifests))
+		}
+		for i, d := range m.Manifests {
+			if d.Platform == nil || platformString(*d.Platform) != platformString(platforms[i].Platform) {
+				t.Fatalf("expected the %s image, got %v", platformString(platforms[i].Platform), d.Platform)
+			}
+			img, err := idx.Image(d.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := img.ConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Architecture != platforms[i].Platform.Architecture {
+				t.Fatalf("expected the %s config, got %s", platforms[i].Platform.Architecture, cfg.Architecture)
+			}
+			if files := imageFiles(t, img); files["app"] != platforms[i].Platform.Architecture {
+				t.Fatalf("unexpected content of the %s image: %v", platforms[i].Platform.Architecture, files)
+			}
+		}
+	})
+}
+
+// pushBaseIndex pushes an index of base images for the platforms, with OCI or Docker media types
+func pushBaseIndex(t *testing.T, ref string, oci bool, platforms ...v1.Platform) {
+	t.Helper()
+	manifestType, configType, indexType := types.DockerManifestSchema2, types.DockerConfigJSON, types.DockerManifestList
+	if oci {
+		manifestType, configType, indexType = types.OCIManifestSchema1, types.OCIConfigJSON, types.OCIImageIndex
+	}
+	idx := mutate.IndexMediaType(empty.Index, indexType)
+	for _, p := range platforms {
+		img, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{OS: p.OS, Architecture: p.Architecture})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img = mutate.ConfigMediaType(mutate.MediaType(img, manifestType), configType)
+		desc, err := partial.Descriptor(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		platform := p
+		desc.Platform = &platform
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{Add: img, Descriptor: *desc})
+	}
+	r, err := name.ParseReference(ref, name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(r, idx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackIndexBaseMediaType(t *testing.T) {
+	host := testRegistry(t)
+	k, err := New(WithRegistryConfig(RegistryConfig{Insecure: []string{host}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm64 := v1.Platform{OS: "linux", Architecture: "arm64"}
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"app": "app"})
+	platforms := []PlatformSources{{Platform: testPlatform, Sources: []string{src + "/."}}, {Platform: arm64, Sources: []string{src + "/."}}}
+
+	for _, tc := range []struct {
+		name                    string
+		oci                     bool
+		indexType, manifestType types.MediaType
+	}{
+		{"oci", true, types.OCIImageIndex, types.OCIManifestSchema1},
+		{"docker", false, types.DockerManifestList, types.DockerManifestSchema2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			base := host + "/base-" + tc.name + ":v1"
+			pushBaseIndex(t, base, tc.oci, testPlatform, arm64)
+
+			image := host + "/app-" + tc.name + ":v1"
+			if err := k.PackIndex(image, platforms, PackLayers{Base: base}, ImageConfig{}, PackOutput{Push: true}); err != nil {
+				t.Fatal(err)
+			}
+			ref, err := name.ParseReference(image, name.Insecure)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx, err := remote.Index(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The OCI index manifests don't hold their media type, it is the one the registry serves them with
+			mt, err := idx.MediaType()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mt != tc.indexType {
+				t.Fatalf("expected the index to be %s, got %s", tc.indexType, mt)
+			}
+			m, err := idx.IndexManifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range m.Manifests {
+				if d.MediaType != tc.manifestType {
+					t.Fatalf("expected the manifests to be %s, got %s", tc.manifestType, d.MediaType)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ParsePlatform parses a platform in the os/arch[/variant] form
+func ParsePlatform(s string) (*v1.Platform, error) {
+	dat := strings.Split(s, "/")
+	if len(dat) < 2 || len(dat) > 3 || dat[0] == "" || dat[1] == "" {
+		return nil, fmt.Errorf("invalid platform '%s', it must be in the form os/arch[/variant]", s)
+	}
+	p := &v1.Platform{OS: dat[0], Architecture: dat[1]}
+	if len(dat) == 3 {
+		p.Variant = dat[2]
+	}
+	return p, nil
+}
+
+func platformString(p v1.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// WithPlatform sets the platform (os/arch[/variant]) of the images to unpack.
+// By default it is linux on the architecture targeted by the Go build ($GOARCH).
+func WithPlatform(s string) Option {
+	return func(k *Bundler) error {
+		if s == "" {
+			return nil
+		}
+		p, err := ParsePlatform(s)
+		if err != nil {
+			return err
+		}
+		k.platform = p
+		return nil
+	}
+}
+
+// goArch returns the architecture targeted by the Go build
+func goArch() string {
+	if a := os.Getenv("GOARCH"); a != "" {
+		return a
+	}
+	return runtime.GOARCH
+}
+
+// Platform returns the platform of the images to unpack
+func (k *Bundler) Platform() v1.Platform {
+	if k.platform != nil {
+		return *k.platform
+	}
+	return v1.Platform{OS: "linux", Architecture: goArch()}
+}
+
+// matchPlatform returns true if the image config or index platform p is the wanted one
+func matchPlatform(p, wanted v1.Platform) bool {
+	return p.OS == wanted.OS && p.Architecture == wanted.Architecture &&
+		(wanted.Variant == "" || p.Variant == "" || p.Variant == wanted.Variant)
+}
+
+// verifyPlatform checks that the resolved image is built for the wanted platform.
+// A mismatch is an error if the platform was requested explicitly, a warning otherwise.
+func (k *Bundler) verifyPlatform(img v1.Image) error {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	got := v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture}
+	if got.OS == "" && got.Architecture == "" {
+		return nil
+	}
+	wanted := k.Platform()
+	if matchPlatform(got, wanted) {
+		return nil
+	}
+	if k.platform != nil {
+		return fmt.Errorf("image platform %s doesn't match the requested platform %s", platformString(got), platformString(wanted))
+	}
+	fmt.Fprintf(os.Stderr, "Warning: image platform %s doesn't match %s, use --platform to select it explicitly\n", platformString(got), platformString(wanted))
+	return nil
+}
@@ -0,0 +1,237 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the poco configuration file
+type Config struct {
+	Registries RegistryConfig `yaml:"registries"`
+}
+
+// RegistryConfig holds the settings used to connect to the registries
+type RegistryConfig struct {
+	// Insecure registries are reached over plain HTTP, or over HTTPS without verifying their certificate
+	Insecure []string `yaml:"insecure"`
+	// Mirrors maps a registry to the one to pull its images from.
+	// The original registry is used if the image can't be pulled from the mirror.
+	Mirrors map[string]string `yaml:"mirrors"`
+	// CAFile is a PEM bundle of certificate authorities trusted along with the system ones
+	CAFile string `yaml:"ca_file"`
+	// Proxy is the proxy URL, in place of the one from $HTTPS_PROXY, $HTTP_PROXY and $NO_PROXY
+	Proxy string `yaml:"proxy"`
+}
+
+// LoadConfig reads a poco configuration file
+func LoadConfig(file string) (*Config, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(dat, c); err != nil {
+		return nil, errors.Wrapf(err, "invalid config file '%s'", file)
+	}
+	return c, nil
+}
+
+// ParseMirror parses a mirror in the from=to form
+func ParseMirror(s string) (string, string, error) {
+	dat := strings.SplitN(s, "=", 2)
+	if len(dat) != 2 || dat[0] == "" || dat[1] == "" {
+		return "", "", fmt.Errorf("invalid registry mirror '%s', it must be in the form registry=mirror", s)
+	}
+	return dat[0], dat[1], nil
+}
+
+// Flags returns the poco flags setting the registry configuration
+func (r RegistryConfig) Flags() []string {
+	var res []string
+	for _, i := range r.Insecure {
+		res = append(res, "--insecure-registry", fmt.Sprintf("%q", i))
+	}
+	var from []string
+	for f := range r.Mirrors {
+		from = append(from, f)
+	}
+	sort.Strings(from)
+	for _, f := range from {
+		res = append(res, "--registry-mirror", fmt.Sprintf("%q", f+"="+r.Mirrors[f]))
+	}
+	if r.CAFile != "" {
+		res = append(res, "--ca-file", fmt.Sprintf("%q", r.CAFile))
+	}
+	if r.Proxy != "" {
+		res = append(res, "--registry-proxy", fmt.Sprintf("%q", r.Proxy))
+	}
+	return res
+}
+
+// registryName normalizes a registry name, e.g. docker.io to index.docker.io
+func registryName(s string) string {
+	if r, err := name.NewRegistry(s); err == nil {
+		return r.RegistryStr()
+	}
+	return s
+}
+
+func (r RegistryConfig) isInsecure(registry string) bool {
+	for _, i := range r.Insecure {
+		if registryName(i) == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseReference parses an image reference, allowing plain HTTP for the insecure registries
+func (r RegistryConfig) ParseReference(s string) (name.Reference, error) {
+	ref, err := name.ParseReference(s)
+	if err != nil {
+		return nil, err
+	}
+	if r.isInsecure(ref.Context().RegistryStr()) {
+		return name.ParseReference(s, name.Insecure)
+	}
+	return ref, nil
+}
+
+// mirror returns the reference of the image in the mirror of its registry, if any
+func (r RegistryConfig) mirror(ref name.Reference) (name.Reference, bool, error) {
+	for from, to := range r.Mirrors {
+		if registryName(from) != ref.Context().RegistryStr() {
+			continue
+		}
+		sep := ":"
+		if _, ok := ref.(name.Digest); ok {
+			sep = "@"
+		}
+		m, err := r.ParseReference(strings.TrimSuffix(to, "/") + "/" + ref.Context().RepositoryStr() + sep + ref.Identifier())
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "invalid mirror '%s' for registry '%s'", to, from)
+		}
+		return m, true, nil
+	}
+	return nil, false, nil
+}
+
+// transport returns the HTTP transport for a registry
+func (r RegistryConfig) transport(registry string) (http.RoundTripper, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if r.Proxy != "" {
+		u, err := url.Parse(r.Proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid proxy '%s'", r.Proxy)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	t.TLSClientConfig = &tls.Config{InsecureSkipVerify: r.isInsecure(registry)}
+	if r.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		dat, err := ioutil.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(dat) {
+			return nil, fmt.Errorf("no certificates found in CA file '%s'", r.CAFile)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	return t, nil
+}
+
+// WithRegistryConfig sets the settings used to connect to the registries
+func WithRegistryConfig(c RegistryConfig) Option {
+	return func(k *Bundler) error {
+		k.registry = c
+		return nil
+	}
+}
+
+// RemoteOptions returns the options to reach the registry of ref
+// with the bundler credentials and registry configuration
+func (k *Bundler) RemoteOptions(ref name.Reference) ([]remote.Option, error) {
+	t, err := k.registry.transport(ref.Context().RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+	return []remote.Option{remote.WithAuthFromKeychain(k.keychain()), remote.WithTransport(t)}, nil
+}
+
+// withMirror calls fn with the reference of the image in its registry mirror, if any,
+// and with the reference in the registry itself if there is no mirror or fn fails on it
+func (k *Bundler) withMirror(image string, fn func(ref name.Reference, opts []remote.Option) error) error {
+	ref, err := k.registry.ParseReference(image)
+	if err != nil {
+		return err
+	}
+
+	refs := []name.Reference{ref}
+	m, ok, err := k.registry.mirror(ref)
+	if err != nil {
+		return err
+	}
+	if ok {
+		refs = []name.Reference{m, ref}
+	}
+
+	for i, r := range refs {
+		opts, err := k.RemoteOptions(r)
+		if err != nil {
+			return err
+		}
+		err = fn(r, append(opts, remote.WithPlatform(k.Platform())))
+		if err == nil || i == len(refs)-1 {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Failed pulling '%s' from mirror, falling back to '%s': %s\n", r, ref, err)
+	}
+	return nil
+}
+
+// remoteImage pulls an image from its registry mirror, or from the registry itself, through the blob cache
+func (k *Bundler) remoteImage(image string) (img v1.Image, err error) {
+	err = k.withMirror(image, func(ref name.Reference, opts []remote.Option) error {
+		img, err = remote.Image(ref, opts...)
+		if err != nil {
+			return err
+		}
+		img = k.withCache(ref, img)
+		return nil
+	})
+	return img, err
+}
@@ -0,0 +1,391 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	containerdarchive "github.com/containerd/containerd/archive"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/mholt/archiver/v3"
+	"github.com/pkg/errors"
+)
+
+// ImageSource provides the images of a transport, e.g. the ones referenced as oci:/path
+type ImageSource interface {
+	// Image returns the image referenced by ref, without the transport prefix
+	Image(ref string) (v1.Image, error)
+}
+
+// ImageSourceFunc is a function implementing ImageSource
+type ImageSourceFunc func(ref string) (v1.Image, error)
+
+// Image implements ImageSource
+func (f ImageSourceFunc) Image(ref string) (v1.Image, error) {
+	return f(ref)
+}
+
+// Transports of the image references provided by the bundler
+const (
+	// TransportRegistry is the default transport, pulling from container registries
+	TransportRegistry = "docker"
+	// TransportDaemon reads the images from the local Docker daemon
+	TransportDaemon = "docker-daemon"
+	// TransportOCI reads the images from an OCI layout directory, as oci:/path[:tag]
+	TransportOCI = "oci"
+	// TransportDockerArchive reads the images from a 'docker save' tarball, as docker-archive:file.tar[:tag]
+	TransportDockerArchive = "docker-archive"
+	// TransportTarball reads a rootfs tarball (optionally compressed) as a single layer image
+	TransportTarball = "tarball"
+	// TransportDir reads a rootfs directory as a single layer image
+	TransportDir = "dir"
+)
+
+// fileTransports reference images by a path on the host
+var fileTransports = []string{TransportOCI, TransportDockerArchive, TransportTarball, TransportDir}
+
+// WithImageSource sets the source of the images referenced with the transport prefix
+func WithImageSource(transport string, s ImageSource) Option {
+	return func(k *Bundler) error {
+		k.sources[transport] = s
+		return nil
+	}
+}
+
+func (k *Bundler) defaultSources() map[string]ImageSource {
+	return map[string]ImageSource{
+		TransportRegistry:      ImageSourceFunc(func(ref string) (v1.Image, error) { return k.remoteImage(strings.TrimPrefix(ref, "//")) }),
+		TransportDaemon:        ImageSourceFunc(daemonImage),
+		TransportOCI:           ImageSourceFunc(k.ociImage),
+		TransportDockerArchive: ImageSourceFunc(dockerArchiveImage),
+		TransportTarball:       ImageSourceFunc(k.tarballImage),
+		TransportDir:           ImageSourceFunc(k.dirImage),
+	}
+}
+
+// SplitTransport splits an image reference in its transport and the reference within it.
+// References without a known transport prefix are registry references.
+func (k *Bundler) SplitTransport(image string) (string, string) {
+	dat := strings.SplitN(image, ":", 2)
+	if len(dat) == 2 {
+		if _, ok := k.sources[dat[0]]; ok {
+			return dat[0], dat[1]
+		}
+	}
+	return TransportRegistry, image
+}
+
+// AbsImage makes the path of images referenced by file transports absolute
+func (k *Bundler) AbsImage(image string) (string, error) {
+	transport, ref := k.SplitTransport(image)
+	if !contains(fileTransports, transport) {
+		return image, nil
+	}
+	p, tag := ref, ""
+	if transport == TransportOCI || transport == TransportDockerArchive {
+		p, tag = splitTag(ref)
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	if tag != "" {
+		abs += ":" + tag
+	}
+	return transport + ":" + abs, nil
+}
+
+// Image returns the image referenced by image, optionally prefixed by its transport
+func (k *Bundler) Image(image string) (v1.Image, error) {
+	transport, ref := k.SplitTransport(image)
+	return k.sources[transport].Image(ref)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// splitTag splits path[:tag], where tag can be a full image reference (e.g. foo/bar:v1)
+func splitTag(ref string) (string, string) {
+	dat := strings.SplitN(ref, ":", 2)
+	if len(dat) == 2 {
+		return dat[0], dat[1]
+	}
+	return ref, ""
+}
+
+func daemonImage(ref string) (v1.Image, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	return daemon.Image(r, daemon.WithUnbufferedOpener())
+}
+
+func dockerArchiveImage(ref string) (v1.Image, error) {
+	p, tag := splitTag(ref)
+	if tag == "" {
+		return tarball.ImageFromPath(p, nil)
+	}
+	t, err := name.NewTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	return tarball.ImageFromPath(p, &t)
+}
+
+// ociImage returns the image tagged as tag in the layout (org.opencontainers.image.ref.name annotation),
+// or its only image if no tag is given
+func (k *Bundler) ociImage(ref string) (v1.Image, error) {
+	p, tag := splitTag(ref)
+	idx, err := layout.ImageIndexFromPath(p)
+	if err != nil {
+		return nil, err
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []v1.Descriptor
+	for _, d := range m.Manifests {
+		refName := d.Annotations[ociRefName]
+		if tag == "" || refName == tag || strings.HasSuffix(refName, ":"+tag) {
+			found = append(found, d)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return nil, fmt.Errorf("no image tagged '%s' in OCI layout '%s'", tag, p)
+	case len(found) > 1:
+		return nil, fmt.Errorf("OCI layout '%s' holds multiple images, specify a tag as oci:%s:<tag>", p, p)
+	}
+	return k.imageFromIndex(idx, found[0])
+}
+
+// imageFromIndex returns the image of a descriptor in an index. If the descriptor is an index itself,
+// the image for the bundler platform is returned.
+// The blobs are verified against their digests, as the layout ones are read as they are.
+func (k *Bundler) imageFromIndex(idx v1.ImageIndex, d v1.Descriptor) (v1.Image, error) {
+	if !d.MediaType.IsIndex() {
+		img, err := idx.Image(d.Digest)
+		if err != nil {
+			return nil, err
+		}
+		return verifiedImage(img, d.Digest)
+	}
+
+	child, err := idx.ImageIndex(d.Digest)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := child.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDigest("index", raw, d.Digest); err != nil {
+		return nil, err
+	}
+	m, err := child.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range m.Manifests {
+		if c.Platform != nil && matchPlatform(*c.Platform, k.Platform()) {
+			return k.imageFromIndex(child, c)
+		}
+	}
+	return nil, fmt.Errorf("no image for %s in index %s", platformString(k.Platform()), d.Digest)
+}
+
+// checkDigest returns an error if the blob dat doesn't match its digest
+func checkDigest(kind string, dat []byte, digest v1.Hash) error {
+	got, _, err := v1.SHA256(bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	if got != digest {
+		return fmt.Errorf("%s %s doesn't match its digest, got %s", kind, digest, got)
+	}
+	return nil
+}
+
+// verifiedImage checks the manifest and the config of img against their digests,
+// and its layers when they are read
+func verifiedImage(img v1.Image, digest v1.Hash) (v1.Image, error) {
+	raw, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDigest("manifest", raw, digest); err != nil {
+		return nil, err
+	}
+	// The manifest descriptor is used, ConfigName could be computed from the config itself
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	raw, err = img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDigest("config", raw, m.Config.Digest); err != nil {
+		return nil, err
+	}
+	return &wrappedImage{Image: img, layer: func(l v1.Layer) v1.Layer { return &verifiedLayer{Layer: l} }}, nil
+}
+
+// verifiedLayer is a layer checked against its digest when read
+type verifiedLayer struct {
+	v1.Layer
+}
+
+func (l *verifiedLayer) Compressed() (io.ReadCloser, error) {
+	h, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	size, err := l.Size()
+	if err != nil {
+		return nil, err
+	}
+	r, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return newVerifiedBlob(r, h, size, func(got v1.Hash, n int64) error {
+		return fmt.Errorf("layer %s doesn't match its digest, got %s (%d bytes)", h, got, n)
+	}), nil
+}
+
+func (l *verifiedLayer) Uncompressed() (io.ReadCloser, error) {
+	r, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return gunzip(r)
+}
+
+// compressionMagics are the leading bytes of the compressed streams, and their decompressors
+var compressionMagics = []struct {
+	magic        []byte
+	decompressor func() archiver.Decompressor
+}{
+	{[]byte{0x1f, 0x8b}, func() archiver.Decompressor { return archiver.NewGz() }},
+	{[]byte("BZh"), func() archiver.Decompressor { return archiver.NewBz2() }},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, func() archiver.Decompressor { return archiver.NewXz() }},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, func() archiver.Decompressor { return archiver.NewZstd() }},
+	{[]byte{0x04, 0x22, 0x4d, 0x18}, func() archiver.Decompressor { return archiver.NewLz4() }},
+	{[]byte("\xff\x06\x00\x00sNaPpY"), func() archiver.Decompressor { return archiver.NewSnappy() }},
+}
+
+// decompressor returns the decompressor of a stream starting with head. Brotli streams,
+// which have no magic number, are recognized by the .br extension of name.
+func decompressor(head []byte, name string) archiver.Decompressor {
+	for _, c := range compressionMagics {
+		if bytes.HasPrefix(head, c.magic) {
+			return c.decompressor()
+		}
+	}
+	if filepath.Ext(name) == ".br" {
+		return archiver.NewBrotli()
+	}
+	return nil
+}
+
+// tarballImage returns an image with the rootfs tarball as its only layer.
+// The tarball can be compressed with any of the formats supported for the bundles,
+// which is detected from its content (e.g. for .tgz files).
+func (k *Bundler) tarballImage(ref string) (v1.Image, error) {
+	if _, err := os.Stat(ref); err != nil {
+		return nil, err
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		f, err := os.Open(ref)
+		if err != nil {
+			return nil, err
+		}
+		br := bufio.NewReader(f)
+		head, _ := br.Peek(10)
+		d := decompressor(head, ref)
+		if d == nil {
+			return struct {
+				io.Reader
+				io.Closer
+			}{br, f}, nil
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			defer f.Close()
+			pw.CloseWithError(d.Decompress(br, pw))
+		}()
+		return pr, nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading rootfs tarball '%s'", ref)
+	}
+	return k.rootfsImage(layer)
+}
+
+// dirImage returns an image with the rootfs directory as its only layer
+func (k *Bundler) dirImage(ref string) (v1.Image, error) {
+	if fi, err := os.Stat(ref); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", ref)
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(containerdarchive.WriteDiff(context.Background(), pw, "", ref))
+		}()
+		return pr, nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading rootfs directory '%s'", ref)
+	}
+	return k.rootfsImage(layer)
+}
+
+// rootfsImage returns an image for the bundler platform with layer as its only layer
+func (k *Bundler) rootfsImage(layer v1.Layer) (v1.Image, error) {
+	p := k.Platform()
+	img, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{OS: p.OS, Architecture: p.Architecture})
+	if err != nil {
+		return nil, err
+	}
+	return mutate.AppendLayers(img, layer)
+}
@@ -0,0 +1,195 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/mholt/archiver/v3"
+)
+
+func TestTarballImageCompression(t *testing.T) {
+	var rootfs bytes.Buffer
+	tw := tar.NewWriter(&rootfs)
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/hostname", Mode: 0644, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte("poco"))
+	tw.Close()
+
+	k, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name       string
+		compressor archiver.Compressor
+	}{
+		{"rootfs.tar", nil},
+		{"rootfs.tgz", archiver.NewGz()},
+		{"rootfs.txz", archiver.NewXz()},
+		{"rootfs.tar.zst", archiver.NewZstd()},
+		{"rootfs.tar.br", archiver.NewBrotli()},
+		// The content wins over the extension
+		{"rootfs-bz2.tar", archiver.NewBz2()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := filepath.Join(dir, tc.name)
+			dat := rootfs.Bytes()
+			if tc.compressor != nil {
+				var buf bytes.Buffer
+				if err := tc.compressor.Compress(bytes.NewReader(dat), &buf); err != nil {
+					t.Fatal(err)
+				}
+				dat = buf.Bytes()
+			}
+			if err := ioutil.WriteFile(p, dat, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			img, err := k.Image(TransportTarball + ":" + p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layers, err := img.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := layers[0].Uncompressed()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			hdr, err := tar.NewReader(r).Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Name != "etc/hostname" {
+				t.Fatalf("expected etc/hostname in the layer, got %s", hdr.Name)
+			}
+		})
+	}
+}
+
+// corruptBlob overwrites a blob of an OCI layout with another content of the same size
+func corruptBlob(t *testing.T, dir string, h v1.Hash) {
+	t.Helper()
+	p := filepath.Join(dir, "blobs", h.Algorithm, h.Hex)
+	dat, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, bytes.Repeat([]byte("x"), len(dat)), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOCIImageDigests(t *testing.T) {
+	k, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeLayout := func(t *testing.T) (string, v1.Image) {
+		dir := t.TempDir()
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := layout.Write(dir, empty.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.AppendImage(img); err != nil {
+			t.Fatal(err)
+		}
+		return dir, img
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		dir, _ := writeLayout(t)
+		img, err := k.Image(TransportOCI + ":" + dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := layers[0].Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("corrupt layer", func(t *testing.T) {
+		dir, orig := writeLayout(t)
+		layers, err := orig.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := layers[0].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		corruptBlob(t, dir, h)
+
+		img, err := k.Image(TransportOCI + ":" + dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if layers, err = img.Layers(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := layers[0].Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if _, err := ioutil.ReadAll(r); err == nil || !strings.Contains(err.Error(), "doesn't match") {
+			t.Fatalf("expected the corrupt layer to fail, got %v", err)
+		}
+	})
+
+	t.Run("corrupt config", func(t *testing.T) {
+		dir, orig := writeLayout(t)
+		h, err := orig.ConfigName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		corruptBlob(t, dir, h)
+
+		if _, err := k.Image(TransportOCI + ":" + dir); err == nil || !strings.Contains(err.Error(), "doesn't match") {
+			t.Fatalf("expected the corrupt config to fail, got %v", err)
+		}
+	})
+}
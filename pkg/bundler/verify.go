@@ -0,0 +1,286 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+)
+
+const (
+	// cosignSignatureAnnotation holds the base64 signature of the payload in the layers of a cosign signature image
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// cosignSignatureType is the type of the cosign simple signing payloads
+	cosignSignatureType = "cosign container image signature"
+)
+
+// Signature is a signature of an image, as stored by cosign: the simple signing payload
+// and its signature. Signature files (e.g. for images not coming from a registry) hold it as JSON.
+type Signature struct {
+	// Payload is the signed simple signing payload, base64 encoded in files
+	Payload []byte `json:"payload"`
+	// Base64Signature is the base64 encoded signature of the payload
+	Base64Signature string `json:"base64Signature"`
+}
+
+// simpleSigning is the payload signed by cosign
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// WithVerifyKey makes the bundler verify the images against a cosign public key before unpacking them.
+// The signatures are read from the signature files, or from the image registry.
+func WithVerifyKey(key string, signatures ...string) Option {
+	return func(k *Bundler) error {
+		if key == "" {
+			if len(signatures) > 0 {
+				return errors.New("signature files require a key to verify them")
+			}
+			return nil
+		}
+		pub, err := loadPublicKey(key)
+		if err != nil {
+			return err
+		}
+		k.verifyKey = pub
+		k.verifyKeyFile = key
+
+		for _, s := range signatures {
+			dat, err := ioutil.ReadFile(s)
+			if err != nil {
+				return err
+			}
+			var sig Signature
+			if err := json.Unmarshal(dat, &sig); err != nil {
+				return errors.Wrapf(err, "invalid signature file '%s'", s)
+			}
+			k.signatures = append(k.signatures, sig)
+		}
+		k.signatureFiles = signatures
+		return nil
+	}
+}
+
+func loadPublicKey(file string) (crypto.PublicKey, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(dat)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("'%s' is not a PEM encoded public key", file)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid public key '%s'", file)
+	}
+	return pub, nil
+}
+
+// verifySignature checks the signature of payload with the public key
+func verifySignature(pub crypto.PublicKey, payload []byte, b64sig string) error {
+	sig, err := base64.StdEncoding.DecodeString(b64sig)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(payload)
+	switch p := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(p, digest[:], sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(p, crypto.SHA256, digest[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(p, payload, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// verify returns nil if the signature is valid and signs one of the digests
+func (s Signature) verify(pub crypto.PublicKey, digests []string) error {
+	if err := verifySignature(pub, s.Payload, s.Base64Signature); err != nil {
+		return err
+	}
+	var p simpleSigning
+	if err := json.Unmarshal(s.Payload, &p); err != nil {
+		return errors.Wrap(err, "invalid signature payload")
+	}
+	if p.Critical.Type != cosignSignatureType {
+		return fmt.Errorf("unexpected signature type '%s'", p.Critical.Type)
+	}
+	for _, d := range digests {
+		if p.Critical.Image.DockerManifestDigest == d {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature is for %s", p.Critical.Image.DockerManifestDigest)
+}
+
+// registrySignatures fetches the cosign signatures of the digest from the image repository (<repo>:sha256-<hex>.sig)
+func (k *Bundler) registrySignatures(repo name.Repository, digest string) (res []Signature, err error) {
+	tag := repo.Name() + ":" + strings.Replace(digest, ":", "-", 1) + ".sig"
+	err = k.withMirror(tag, func(ref name.Reference, opts []remote.Option) error {
+		res = nil
+		img, err := remote.Image(ref, opts...)
+		if err != nil {
+			return err
+		}
+		m, err := img.Manifest()
+		if err != nil {
+			return err
+		}
+		for _, l := range m.Layers {
+			b64sig, ok := l.Annotations[cosignSignatureAnnotation]
+			if !ok {
+				continue
+			}
+			layer, err := img.LayerByDigest(l.Digest)
+			if err != nil {
+				return err
+			}
+			r, err := layer.Compressed()
+			if err != nil {
+				return err
+			}
+			payload, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			res = append(res, Signature{Payload: payload, Base64Signature: b64sig})
+		}
+		return nil
+	})
+	return res, err
+}
+
+// pinDigest returns the registry image reference pinned to the digest it resolves to, so that the image
+// verified is the one unpacked even if the tag moves in the meantime
+func (k *Bundler) pinDigest(image string) (string, error) {
+	image = strings.TrimPrefix(image, "//")
+	r, err := k.registry.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := r.(name.Digest); ok {
+		return image, nil
+	}
+	digest, _, err := k.resolveDigest(image)
+	if err != nil {
+		return "", errors.Wrapf(err, "failure while resolving the digest of '%s'", image)
+	}
+	return r.Context().Name() + "@" + digest, nil
+}
+
+// indexLists checks that the index pulled by digest lists the manifest
+func (k *Bundler) indexLists(index name.Digest, manifest v1.Hash) error {
+	return k.withMirror(index.String(), func(ref name.Reference, opts []remote.Option) error {
+		idx, err := remote.Index(ref, opts...)
+		if err != nil {
+			return err
+		}
+		m, err := idx.IndexManifest()
+		if err != nil {
+			return err
+		}
+		for _, d := range m.Manifests {
+			if d.Digest == manifest {
+				return nil
+			}
+		}
+		return fmt.Errorf("index %s doesn't list the image %s", index.DigestStr(), manifest)
+	})
+}
+
+// verifyImage checks that the image is signed with the bundler key, before unpacking it.
+// Registry images must be pulled by digest: signatures can sign either that digest, once checked
+// to be an index listing the image, or the image manifest.
+// Images from directories and tarballs can only be verified with signature files.
+func (k *Bundler) verifyImage(transport, ref string, img v1.Image) error {
+	if k.verifyKey == nil {
+		return nil
+	}
+
+	manifest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	digests := []string{manifest.String()}
+
+	signatures := k.signatures
+	switch transport {
+	case TransportRegistry:
+		r, err := k.registry.ParseReference(strings.TrimPrefix(ref, "//"))
+		if err != nil {
+			return err
+		}
+		if d, ok := r.(name.Digest); ok && d.DigestStr() != manifest.String() {
+			if err := k.indexLists(d, manifest); err != nil {
+				return err
+			}
+			digests = append([]string{d.DigestStr()}, digests...)
+		}
+		for _, d := range digests {
+			sigs, err := k.registrySignatures(r.Context(), d)
+			if err == nil {
+				signatures = append(signatures, sigs...)
+			}
+		}
+	case TransportDir, TransportTarball:
+		if len(signatures) == 0 {
+			return fmt.Errorf("cannot verify signatures for dir: and tarball: sources without a signature file covering the manifest digest %s", manifest)
+		}
+	}
+
+	if len(signatures) == 0 {
+		return fmt.Errorf("no signature found for %s", strings.Join(digests, ", "))
+	}
+	var failures []string
+	for _, s := range signatures {
+		err := s.verify(k.verifyKey, digests)
+		if err == nil {
+			fmt.Printf("Verified signature of %s\n", strings.Join(digests, ", "))
+			return nil
+		}
+		failures = append(failures, err.Error())
+	}
+	return fmt.Errorf("no valid signature found for %s: %s", strings.Join(digests, ", "), strings.Join(failures, "; "))
+}
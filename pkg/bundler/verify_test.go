@@ -0,0 +1,243 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package bundler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+)
+
+// testRegistry starts an in-process registry and returns its host
+func testRegistry(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// writeKey generates an ECDSA key pair, and writes the public key as PEM in dir
+func writeKey(t *testing.T, dir, name string) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return priv, file
+}
+
+func push(t *testing.T, ref string, img v1.Image) v1.Hash {
+	t.Helper()
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(r, img, remote.WithPlatform(v1.Platform{OS: "linux", Architecture: "amd64"})); err != nil {
+		t.Fatal(err)
+	}
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// sign pushes a cosign signature of digest to repo, as cosign stores it
+func sign(t *testing.T, priv *ecdsa.PrivateKey, repo string, digest v1.Hash) {
+	t.Helper()
+	var payload simpleSigning
+	payload.Critical.Type = cosignSignatureType
+	payload.Critical.Image.DockerManifestDigest = digest.String()
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(dat)
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(dat, "application/vnd.dev.cosign.simplesigning.v1+json"),
+		Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, repo+":"+digest.Algorithm+"-"+digest.Hex+".sig", img)
+}
+
+func TestVerifyImage(t *testing.T) {
+	host := testRegistry(t)
+	dir := t.TempDir()
+	priv, key := writeKey(t, dir, "cosign.pub")
+	_, otherKey := writeKey(t, dir, "other.pub")
+	repo := host + "/test/app"
+
+	signed, err := random.Image(512, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign(t, priv, repo, push(t, repo+":signed", signed))
+
+	unsigned, err := random.Image(512, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, repo+":unsigned", unsigned)
+
+	// A multi-arch index, signed as a whole
+	child, err := random.Image(512, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        child,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+	})
+	r, err := name.ParseReference(repo + ":index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(r, idx); err != nil {
+		t.Fatal(err)
+	}
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign(t, priv, repo, idxDigest)
+
+	for _, c := range []struct {
+		name, image, key string
+		wantErr          string
+	}{
+		{name: "good signature", image: repo + ":signed", key: key},
+		{name: "wrong key", image: repo + ":signed", key: otherKey, wantErr: "no valid signature"},
+		{name: "missing signature", image: repo + ":unsigned", key: key, wantErr: "no signature found"},
+		{name: "index signature", image: repo + ":index", key: key},
+		{name: "index signature, wrong key", image: repo + ":index", key: otherKey, wantErr: "no valid signature"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			k, err := New(
+				WithRegistryConfig(RegistryConfig{Insecure: []string{host}}),
+				WithPlatform("linux/amd64"),
+				WithVerifyKey(c.key),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = k.DownloadImage(c.image, t.TempDir(), false)
+			switch {
+			case c.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+				t.Fatalf("expected error containing '%s', got %v", c.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestVerifyIndexListsImage(t *testing.T) {
+	host := testRegistry(t)
+	dir := t.TempDir()
+	priv, key := writeKey(t, dir, "cosign.pub")
+	repo := host + "/test/app"
+
+	// A signed index, and an image it doesn't list
+	child, err := random.Image(512, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        child,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+	})
+	r, err := name.ParseReference(repo + ":index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(r, idx); err != nil {
+		t.Fatal(err)
+	}
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign(t, priv, repo, idxDigest)
+
+	other, err := random.Image(512, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, repo+":other", other)
+
+	k, err := New(WithRegistryConfig(RegistryConfig{Insecure: []string{host}}), WithVerifyKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.verifyImage(TransportRegistry, repo+"@"+idxDigest.String(), other)
+	if err == nil || !strings.Contains(err.Error(), "doesn't list") {
+		t.Fatalf("expected the image not listed in the signed index to be rejected, got %v", err)
+	}
+}
+
+func TestVerifyDirWithoutSignature(t *testing.T) {
+	_, key := writeKey(t, t.TempDir(), "cosign.pub")
+	k, err := New(WithVerifyKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(512, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, transport := range []string{TransportDir, TransportTarball} {
+		err := k.verifyImage(transport, "/some/path", img)
+		if err == nil || !strings.Contains(err.Error(), "cannot verify signatures") {
+			t.Fatalf("expected %s sources to fail verification, got %v", transport, err)
+		}
+	}
+}
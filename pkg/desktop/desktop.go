@@ -0,0 +1,270 @@
+// Copyright © 2021 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package desktop
+
+import (
+	"bufio"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	cp "github.com/otiai10/copy"
+	"github.com/pkg/errors"
+)
+
+// EntryFile is the desktop entry file name inside the output dir
+const EntryFile = "entry.desktop"
+
+// IconsDir is the directory inside the output dir holding the icons,
+// in the hicolor theme layout (<size>/apps/icon.<ext>)
+const IconsDir = "icons"
+
+type config struct {
+	rootfs      string
+	outDir      string
+	name        string
+	description string
+	entrypoint  string
+	desktopFile string
+	icon        string
+}
+
+// WithRootfs sets the rootfs where to discover the desktop entries and icons
+func WithRootfs(s string) option {
+	return func(k *config) error {
+		k.rootfs = s
+		return nil
+	}
+}
+
+// WithOutputDir sets the output dir of the desktop assets
+func WithOutputDir(s string) option {
+	return func(k *config) error {
+		k.outDir = s
+		return nil
+	}
+}
+
+// WithApp sets the app name, description and entrypoint used to
+// find the desktop entry in the rootfs, or to generate one
+func WithApp(name, description, entrypoint string) option {
+	return func(k *config) error {
+		k.name = name
+		k.description = description
+		k.entrypoint = entrypoint
+		return nil
+	}
+}
+
+// WithDesktopFile sets an explicit desktop entry in place of discovering it from the rootfs
+func WithDesktopFile(s string) option {
+	return func(k *config) error {
+		k.desktopFile = s
+		return nil
+	}
+}
+
+// WithIcon sets an explicit icon (png or svg) in place of discovering it from the rootfs
+func WithIcon(s string) option {
+	return func(k *config) error {
+		k.icon = s
+		return nil
+	}
+}
+
+// Option is a desktop option
+type option func(k *config) error
+
+// Pack collects the desktop entry and icons of an app into a folder.
+// If no desktop entry is given nor found in the rootfs, a minimal one is generated.
+func Pack(o ...option) error {
+	config := &config{}
+	for _, oo := range o {
+		if err := oo(config); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(config.outDir, IconsDir), os.ModePerm); err != nil {
+		return err
+	}
+
+	entry := config.desktopFile
+	if entry == "" {
+		entry = findEntry(config.rootfs, config.entrypoint)
+	}
+
+	var iconName string
+	if entry != "" {
+		fmt.Println("Using desktop entry", entry)
+		if err := cp.Copy(entry, filepath.Join(config.outDir, EntryFile)); err != nil {
+			return err
+		}
+		iconName = entryValue(entry, "Icon")
+	} else {
+		fmt.Println("No desktop entry found, generating one")
+		if err := ioutil.WriteFile(filepath.Join(config.outDir, EntryFile), []byte(defaultEntry(config)), 0644); err != nil {
+			return err
+		}
+	}
+
+	if config.icon != "" {
+		return copyIcon(config.icon, filepath.Join(config.outDir, IconsDir))
+	}
+
+	for _, icon := range findIcons(config.rootfs, iconName) {
+		if err := copyIcon(icon, filepath.Join(config.outDir, IconsDir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func defaultEntry(c *config) string {
+	return fmt.Sprintf(`[Desktop Entry]
+Type=Application
+Name=%s
+Comment=%s
+Exec=%s
+Terminal=true
+`, c.name, c.description, c.entrypoint)
+}
+
+// findEntry returns the desktop entry in the rootfs which executes the entrypoint,
+// or the only one available
+func findEntry(rootfs, entrypoint string) string {
+	if rootfs == "" {
+		return ""
+	}
+	var entries []string
+	found, _ := filepath.Glob(filepath.Join(rootfs, "usr", "share", "applications", "*.desktop"))
+	for _, e := range found {
+		if e, err := resolve(rootfs, e); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	for _, e := range entries {
+		fields := strings.Fields(entryValue(e, "Exec"))
+		if len(fields) > 0 && filepath.Base(fields[0]) == filepath.Base(entrypoint) {
+			return e
+		}
+	}
+	if len(entries) == 1 {
+		return entries[0]
+	}
+	return ""
+}
+
+// entryValue returns the value of key in the main group of a desktop entry
+func entryValue(entry, key string) string {
+	f, err := os.Open(entry)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	group := ""
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			group = line
+			continue
+		}
+		if group != "[Desktop Entry]" {
+			continue
+		}
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 && strings.TrimSpace(kv[0]) == key {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+// findIcons returns all the icons available in the rootfs for the given icon name
+func findIcons(rootfs, name string) []string {
+	if rootfs == "" || name == "" {
+		return nil
+	}
+	var candidates []string
+	if filepath.IsAbs(name) {
+		candidates = []string{filepath.Join(rootfs, name)}
+	} else {
+		for _, ext := range []string{"png", "svg"} {
+			found, _ := filepath.Glob(filepath.Join(rootfs, "usr", "share", "icons", "hicolor", "*", "apps", name+"."+ext))
+			candidates = append(candidates, found...)
+		}
+		if len(candidates) == 0 {
+			for _, ext := range []string{"png", "svg"} {
+				candidates = append(candidates, filepath.Join(rootfs, "usr", "share", "pixmaps", name+"."+ext))
+			}
+		}
+	}
+
+	var icons []string
+	for _, c := range candidates {
+		if c, err := resolve(rootfs, c); err == nil {
+			icons = append(icons, c)
+		}
+	}
+	return icons
+}
+
+// resolve follows the symlinks of a path inside the rootfs, without escaping it.
+// It returns an error if the resolved path doesn't exist.
+func resolve(rootfs, p string) (string, error) {
+	rel, err := filepath.Rel(rootfs, p)
+	if err != nil {
+		return "", err
+	}
+	res, err := securejoin.SecureJoin(rootfs, rel)
+	if err != nil {
+		return "", err
+	}
+	_, err = os.Stat(res)
+	return res, err
+}
+
+// iconSize returns the hicolor size directory of an icon
+func iconSize(icon string) (string, error) {
+	if filepath.Ext(icon) == ".svg" {
+		return "scalable", nil
+	}
+
+	f, err := os.Open(icon)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	c, err := png.DecodeConfig(f)
+	if err != nil {
+		return "", errors.Wrapf(err, "icon '%s' is not a png or svg file", icon)
+	}
+	return fmt.Sprintf("%dx%d", c.Width, c.Height), nil
+}
+
+func copyIcon(icon, dst string) error {
+	size, err := iconSize(icon)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Using icon", icon, "as", size)
+	return cp.Copy(icon, filepath.Join(dst, size, "apps", "icon"+filepath.Ext(icon)))
+}
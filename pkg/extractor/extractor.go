@@ -13,6 +13,7 @@ import (
 type config struct {
 	files  []string
 	outDir string
+	root   string
 }
 
 // WithFiles sets the input files of the packer
@@ -31,16 +32,60 @@ func WithOutputDir(s string) option {
 	}
 }
 
+// WithRoot sets the root filesystem the files and their libraries are looked up in, in place of the host one
+func WithRoot(s string) option {
+	return func(k *config) error {
+		k.root = s
+		return nil
+	}
+}
+
 // Option is an extractor option
 type option func(k *config) error
 
-// Extract a binary and its deps into a folder
-func Extract(o ...option) error {
+func newConfig(o ...option) (*config, error) {
 	config := &config{}
 	for _, oo := range o {
 		if err := oo(config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Dependencies returns the files, the libraries they load and the symlinks leading to them.
+// With a root filesystem, the paths are inside it.
+func Dependencies(o ...option) ([]string, error) {
+	config, err := newConfig(o...)
+	if err != nil {
+		return nil, err
+	}
+	if config.root != "" {
+		return rootDependencies(config.root, config.files)
+	}
+	return ldd.List(config.files)
+}
+
+// Extract a binary and its deps into a folder
+func Extract(o ...option) error {
+	config, err := newConfig(o...)
+	if err != nil {
+		return err
+	}
+
+	if config.root != "" {
+		files, err := rootDependencies(config.root, config.files)
+		if err != nil {
 			return err
 		}
+		for _, f := range files {
+			fmt.Println("Found", f)
+			os.MkdirAll(filepath.Join(config.outDir, path.Dir(f)), os.ModePerm)
+			if err := cp.Copy(filepath.Join(config.root, f), filepath.Join(config.outDir, f)); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
 	files, err := ldd.Ldd(config.files)
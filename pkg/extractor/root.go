@@ -0,0 +1,424 @@
+package extractor
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxSymlinks is the maximum number of symlinks followed resolving a path, as in the kernel
+const maxSymlinks = 40
+
+// defaultPath is looked up for the interpreters of /usr/bin/env scripts
+var defaultPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// resolve resolves the path p in the root filesystem, without escaping it.
+// It returns the symlinks met on the way and the resolved path.
+func resolve(root, p string) (links []string, real string, err error) {
+	todo := strings.Split(p, "/")
+	real = "/"
+	for hops := 0; len(todo) > 0; {
+		c := todo[0]
+		todo = todo[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			real = path.Dir(real)
+			continue
+		}
+
+		next := path.Join(real, c)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return nil, "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			real = next
+			continue
+		}
+
+		if hops++; hops > maxSymlinks {
+			return nil, "", fmt.Errorf("too many levels of symbolic links resolving '%s'", p)
+		}
+		links = append(links, next)
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return nil, "", err
+		}
+		if path.IsAbs(target) {
+			real = "/"
+		}
+		todo = append(strings.Split(target, "/"), todo...)
+	}
+	return links, real, nil
+}
+
+// rootResolver collects the dependencies of files in a root filesystem, without running them.
+// The libraries are looked up as the dynamic loader does, so that binaries built for another
+// architecture than the host one can be resolved.
+type rootResolver struct {
+	root    string
+	seen    map[string]bool
+	res     []string
+	visited map[string]bool
+	conf    []string
+	confOK  bool
+}
+
+// loader is what the libraries needed by an ELF object are looked up with
+type loader struct {
+	// interp is the dynamic loader of the executable
+	interp string
+	// rpath are the DT_RPATH directories of the object and of the ones loading it
+	rpath []string
+}
+
+func (r *rootResolver) keep(p string) {
+	if !r.seen[p] {
+		r.seen[p] = true
+		r.res = append(r.res, p)
+	}
+}
+
+// follow keeps p, the symlinks leading to it and returns its resolved path
+func (r *rootResolver) follow(p string) (string, error) {
+	links, real, err := resolve(r.root, p)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range links {
+		r.keep(l)
+	}
+	r.keep(real)
+	return real, nil
+}
+
+// add keeps the file and what it needs to run: its interpreter and libraries,
+// or the interpreter of scripts
+func (r *rootResolver) add(file string) error {
+	real, err := r.follow(file)
+	if err != nil {
+		return err
+	}
+	if r.visited[real] {
+		return nil
+	}
+	r.visited[real] = true
+
+	full := filepath.Join(r.root, real)
+	if fi, err := os.Stat(full); err != nil || !fi.Mode().IsRegular() {
+		return err
+	}
+
+	interp, command, err := shebang(full)
+	if err != nil {
+		return err
+	}
+	if interp != "" {
+		if command != "" {
+			if err := r.add(r.lookPath(command)); err != nil {
+				return err
+			}
+		}
+		return r.add(interp)
+	}
+
+	f, err := elf.Open(full)
+	if err != nil {
+		// Not an executable nor a library
+		return nil
+	}
+	defer f.Close()
+
+	// The dynamic loader of the libraries, e.g. the one of libc, is not the one running them
+	var l loader
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		dat := make([]byte, p.Filesz)
+		if _, err := p.ReadAt(dat, 0); err != nil {
+			return err
+		}
+		l.interp = strings.TrimRight(string(dat), "\x00")
+		if _, err := r.follow(l.interp); err != nil {
+			return errors.Wrapf(err, "dynamic loader of '%s' not found", real)
+		}
+	}
+	return r.addELF(real, f, l)
+}
+
+// addELF keeps the libraries needed by the ELF object at real, recursively
+func (r *rootResolver) addELF(real string, f *elf.File, l loader) error {
+	needed, err := f.ImportedLibraries()
+	if err != nil || len(needed) == 0 {
+		return nil
+	}
+	rpath, _ := f.DynString(elf.DT_RPATH)
+	runpath, _ := f.DynString(elf.DT_RUNPATH)
+
+	// As in glibc, DT_RPATH is ignored for objects having DT_RUNPATH,
+	// which applies to their own dependencies only
+	origin := path.Dir(real)
+	var own []string
+	if len(runpath) == 0 {
+		for _, p := range rpath {
+			own = append(own, r.expand(p, origin, f)...)
+		}
+	}
+	deps := loader{interp: l.interp, rpath: append(own, l.rpath...)}
+	dirs := append([]string{}, deps.rpath...)
+	if len(runpath) > 0 {
+		dirs = nil
+		for _, p := range runpath {
+			dirs = append(dirs, r.expand(p, origin, f)...)
+		}
+	}
+	dirs = append(dirs, r.libraryPath(l.interp, f)...)
+
+	var missing []string
+	for _, n := range needed {
+		lib, ok := r.find(n, dirs, f)
+		if !ok {
+			missing = append(missing, n)
+			continue
+		}
+		if err := r.addLib(lib, deps); err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("libraries of '%s' not found: %s", real, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// addLib keeps the library at p, the symlinks leading to it and its own libraries
+func (r *rootResolver) addLib(p string, l loader) error {
+	real, err := r.follow(p)
+	if err != nil {
+		return err
+	}
+	if r.visited[real] {
+		return nil
+	}
+	r.visited[real] = true
+
+	f, err := elf.Open(filepath.Join(r.root, real))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.addELF(real, f, l)
+}
+
+// find looks up the library name in dirs, skipping the files not built for the class and machine of obj
+func (r *rootResolver) find(name string, dirs []string, obj *elf.File) (string, bool) {
+	if strings.Contains(name, "/") {
+		return name, r.compatible(name, obj)
+	}
+	for _, d := range dirs {
+		p := path.Join(d, name)
+		if r.compatible(p, obj) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// compatible returns true if p is an ELF file with the class and machine of obj
+func (r *rootResolver) compatible(p string, obj *elf.File) bool {
+	_, real, err := resolve(r.root, p)
+	if err != nil {
+		return false
+	}
+	f, err := elf.Open(filepath.Join(r.root, real))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return f.Class == obj.Class && f.Machine == obj.Machine
+}
+
+// expand splits a DT_RPATH or DT_RUNPATH value, substituting $ORIGIN and $LIB.
+// $LIB is expanded to the multiarch directories of the object machine (e.g. lib/x86_64-linux-gnu),
+// then to lib64 or lib, as distributions configure it differently.
+// Directories using $PLATFORM, which depends on the host, are skipped.
+func (r *rootResolver) expand(s, origin string, obj *elf.File) []string {
+	var libs []string
+	for _, t := range multiarch[obj.Machine] {
+		libs = append(libs, "lib/"+t)
+	}
+	if obj.Class == elf.ELFCLASS64 {
+		libs = append(libs, "lib64")
+	}
+	libs = append(libs, "lib")
+
+	var res []string
+	for _, d := range strings.Split(s, ":") {
+		if d == "" || strings.Contains(d, "PLATFORM") {
+			continue
+		}
+		d = strings.NewReplacer("${ORIGIN}", origin, "$ORIGIN", origin).Replace(d)
+		for _, lib := range libs {
+			e := strings.NewReplacer("${LIB}", lib, "$LIB", lib).Replace(d)
+			if path.IsAbs(e) {
+				res = append(res, path.Clean(e))
+			}
+			// Without $LIB, the directory is added once
+			if e == d {
+				break
+			}
+		}
+	}
+	return res
+}
+
+// multiarch are the Debian multiarch directories names of the machines, searched by default by its glibc
+var multiarch = map[elf.Machine][]string{
+	elf.EM_X86_64:  {"x86_64-linux-gnu"},
+	elf.EM_386:     {"i386-linux-gnu"},
+	elf.EM_AARCH64: {"aarch64-linux-gnu"},
+	elf.EM_ARM:     {"arm-linux-gnueabihf", "arm-linux-gnueabi"},
+	elf.EM_PPC64:   {"powerpc64le-linux-gnu", "powerpc64-linux-gnu"},
+	elf.EM_S390:    {"s390x-linux-gnu"},
+	elf.EM_RISCV:   {"riscv64-linux-gnu"},
+	elf.EM_MIPS:    {"mips64el-linux-gnuabi64", "mipsel-linux-gnu", "mips-linux-gnu"},
+}
+
+// libraryPath returns the directories searched after the ones of the objects: the musl path file
+// or the musl defaults with a musl loader, the ld.so.conf ones and the glibc defaults otherwise
+func (r *rootResolver) libraryPath(interp string, obj *elf.File) []string {
+	if base := path.Base(interp); strings.HasPrefix(base, "ld-musl-") {
+		arch := strings.TrimSuffix(strings.TrimPrefix(base, "ld-musl-"), ".so.1")
+		if dat, err := r.readFile("/etc/ld-musl-" + arch + ".path"); err == nil {
+			return strings.FieldsFunc(string(dat), func(c rune) bool { return c == ':' || c == '\n' })
+		}
+		return []string{"/lib", "/usr/local/lib", "/usr/lib"}
+	}
+
+	if !r.confOK {
+		r.conf = r.ldSoConf("/etc/ld.so.conf", map[string]bool{})
+		r.confOK = true
+	}
+	dirs := append([]string{}, r.conf...)
+	for _, t := range multiarch[obj.Machine] {
+		dirs = append(dirs, "/lib/"+t, "/usr/lib/"+t)
+	}
+	if obj.Class == elf.ELFCLASS64 {
+		dirs = append(dirs, "/lib64", "/usr/lib64")
+	}
+	return append(dirs, "/lib", "/usr/lib")
+}
+
+// ldSoConf returns the directories listed in an ld.so.conf file of the root filesystem and the files it includes
+func (r *rootResolver) ldSoConf(file string, seen map[string]bool) []string {
+	if seen[file] {
+		return nil
+	}
+	seen[file] = true
+	dat, err := r.readFile(file)
+	if err != nil {
+		return nil
+	}
+
+	var res []string
+	for _, line := range strings.Split(string(dat), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.FieldsFunc(line, func(c rune) bool { return c == ' ' || c == '\t' || c == ':' || c == ',' })
+		if len(fields) == 0 || fields[0] == "hwcap" {
+			continue
+		}
+		if fields[0] != "include" {
+			res = append(res, fields...)
+			continue
+		}
+		for _, g := range fields[1:] {
+			if !path.IsAbs(g) {
+				g = path.Join(path.Dir(file), g)
+			}
+			matches, _ := filepath.Glob(filepath.Join(r.root, g))
+			sort.Strings(matches)
+			for _, m := range matches {
+				rel, err := filepath.Rel(r.root, m)
+				if err != nil {
+					continue
+				}
+				res = append(res, r.ldSoConf(path.Join("/", filepath.ToSlash(rel)), seen)...)
+			}
+		}
+	}
+	return res
+}
+
+// readFile reads a file of the root filesystem, following its symlinks inside it
+func (r *rootResolver) readFile(p string) ([]byte, error) {
+	_, real, err := resolve(r.root, p)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(r.root, real))
+}
+
+// lookPath resolves the commands of /usr/bin/env scripts in the default PATH
+func (r *rootResolver) lookPath(interp string) string {
+	if path.IsAbs(interp) {
+		return interp
+	}
+	for _, d := range defaultPath {
+		p := path.Join(d, interp)
+		if _, real, err := resolve(r.root, p); err == nil {
+			if fi, err := os.Stat(filepath.Join(r.root, real)); err == nil && fi.Mode().IsRegular() {
+				return p
+			}
+		}
+	}
+	return path.Join("/usr/bin", interp)
+}
+
+// shebang returns the interpreter of a script, and the command run by /usr/bin/env
+func shebang(file string) (interp, command string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	if !strings.HasPrefix(line, "#!") {
+		return "", "", nil
+	}
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return "", "", nil
+	}
+	if path.Base(fields[0]) == "env" {
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") && !strings.Contains(f, "=") {
+				return fields[0], f, nil
+			}
+		}
+	}
+	return fields[0], "", nil
+}
+
+// rootDependencies returns the files, the libraries they load and the symlinks leading to them in the root filesystem
+func rootDependencies(root string, files []string) ([]string, error) {
+	r := &rootResolver{root: root, seen: map[string]bool{}, visited: map[string]bool{}}
+	for _, f := range files {
+		if err := r.add(f); err != nil {
+			return nil, err
+		}
+	}
+	return r.res, nil
+}
@@ -0,0 +1,273 @@
+package extractor
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	glibcLoader = "/lib64/ld-linux-x86-64.so.2"
+	muslLoader  = "/lib/ld-musl-x86_64.so.1"
+)
+
+// object describes a minimal x86_64 ELF object, with only what the resolver reads
+type object struct {
+	interp  string
+	needed  []string
+	rpath   string
+	runpath string
+}
+
+// writeELF writes obj as an ELF file: the program header of its interpreter
+// and a dynamic section with its string table
+func writeELF(t *testing.T, p string, obj object) {
+	t.Helper()
+
+	dynstr := []byte{0}
+	str := func(s string) uint64 {
+		off := len(dynstr)
+		dynstr = append(dynstr, append([]byte(s), 0)...)
+		return uint64(off)
+	}
+	var dyn []elf.Dyn64
+	for _, n := range obj.needed {
+		dyn = append(dyn, elf.Dyn64{Tag: int64(elf.DT_NEEDED), Val: str(n)})
+	}
+	if obj.rpath != "" {
+		dyn = append(dyn, elf.Dyn64{Tag: int64(elf.DT_RPATH), Val: str(obj.rpath)})
+	}
+	if obj.runpath != "" {
+		dyn = append(dyn, elf.Dyn64{Tag: int64(elf.DT_RUNPATH), Val: str(obj.runpath)})
+	}
+	dyn = append(dyn, elf.Dyn64{Tag: int64(elf.DT_NULL)})
+	shstrtab := []byte("\x00.dynstr\x00.dynamic\x00.shstrtab\x00")
+
+	var dynamic bytes.Buffer
+	binary.Write(&dynamic, binary.LittleEndian, dyn)
+	interp := []byte{}
+	if obj.interp != "" {
+		interp = append([]byte(obj.interp), 0)
+	}
+
+	// Header, program header, interpreter, .dynstr, .dynamic, .shstrtab, section headers
+	const ehsize, phsize, shsize = 64, 56, 64
+	interpOff := uint64(ehsize + phsize)
+	dynstrOff := interpOff + uint64(len(interp))
+	dynamicOff := dynstrOff + uint64(len(dynstr))
+	shstrtabOff := dynamicOff + uint64(dynamic.Len())
+	shOff := shstrtabOff + uint64(len(shstrtab))
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_DYN),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     ehsize,
+		Shoff:     shOff,
+		Ehsize:    ehsize,
+		Phentsize: phsize,
+		Shentsize: shsize,
+		Shnum:     4,
+		Shstrndx:  3,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	// Without interpreter, the program header is a null entry
+	prog := elf.Prog64{Type: uint32(elf.PT_NULL)}
+	if obj.interp != "" {
+		hdr.Phnum = 1
+		prog = elf.Prog64{Type: uint32(elf.PT_INTERP), Off: interpOff, Filesz: uint64(len(interp)), Memsz: uint64(len(interp))}
+	}
+	sections := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: dynstrOff, Size: uint64(len(dynstr))},
+		{Name: 9, Type: uint32(elf.SHT_DYNAMIC), Off: dynamicOff, Size: uint64(dynamic.Len()), Link: 1, Entsize: 16},
+		{Name: 18, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint64(len(shstrtab))},
+	}
+
+	var buf bytes.Buffer
+	for _, data := range []interface{}{hdr, prog, interp, dynstr, dynamic.Bytes(), shstrtab, sections} {
+		if err := binary.Write(&buf, binary.LittleEndian, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, buf.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRootDependencies(t *testing.T) {
+	lib := object{}
+	for _, tc := range []struct {
+		name    string
+		objects map[string]object
+		files   map[string]string
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "rpath",
+			objects: map[string]object{
+				"/bin/app":             {interp: glibcLoader, needed: []string{"libfoo.so"}, rpath: "/opt/rpath"},
+				"/opt/rpath/libfoo.so": lib,
+				"/usr/lib/libfoo.so":   lib,
+			},
+			want:    []string{"/opt/rpath/libfoo.so"},
+			notWant: []string{"/usr/lib/libfoo.so"},
+		},
+		{
+			name: "runpath over rpath",
+			objects: map[string]object{
+				"/bin/app":               {interp: glibcLoader, needed: []string{"libfoo.so"}, rpath: "/opt/rpath", runpath: "/opt/runpath"},
+				"/opt/rpath/libfoo.so":   lib,
+				"/opt/runpath/libfoo.so": lib,
+			},
+			want:    []string{"/opt/runpath/libfoo.so"},
+			notWant: []string{"/opt/rpath/libfoo.so"},
+		},
+		{
+			name: "rpath applies to the dependencies",
+			objects: map[string]object{
+				"/bin/app":             {interp: glibcLoader, needed: []string{"libfoo.so"}, rpath: "/opt/rpath"},
+				"/opt/rpath/libfoo.so": {needed: []string{"libbar.so"}},
+				"/opt/rpath/libbar.so": lib,
+				"/usr/lib/libbar.so":   lib,
+			},
+			want:    []string{"/opt/rpath/libfoo.so", "/opt/rpath/libbar.so"},
+			notWant: []string{"/usr/lib/libbar.so"},
+		},
+		{
+			name: "runpath doesn't apply to the dependencies",
+			objects: map[string]object{
+				"/bin/app":               {interp: glibcLoader, needed: []string{"libfoo.so"}, runpath: "/opt/runpath"},
+				"/opt/runpath/libfoo.so": {needed: []string{"libbar.so"}},
+				"/opt/runpath/libbar.so": lib,
+				"/usr/lib/libbar.so":     lib,
+			},
+			want:    []string{"/opt/runpath/libfoo.so", "/usr/lib/libbar.so"},
+			notWant: []string{"/opt/runpath/libbar.so"},
+		},
+		{
+			name: "origin",
+			objects: map[string]object{
+				"/opt/app/bin/app":       {interp: glibcLoader, needed: []string{"libfoo.so"}, runpath: "$ORIGIN/../lib"},
+				"/opt/app/lib/libfoo.so": lib,
+				"/usr/lib/libfoo.so":     lib,
+			},
+			files: map[string]string{"/bin/app": "->../opt/app/bin/app"},
+			want:  []string{"/bin/app", "/opt/app/bin/app", "/opt/app/lib/libfoo.so"},
+		},
+		{
+			name: "lib multiarch",
+			objects: map[string]object{
+				"/bin/app":                            {interp: glibcLoader, needed: []string{"libfoo.so"}, runpath: "/opt/${LIB}"},
+				"/opt/lib/x86_64-linux-gnu/libfoo.so": lib,
+				"/opt/lib64/libfoo.so":                lib,
+			},
+			want: []string{"/opt/lib/x86_64-linux-gnu/libfoo.so"},
+		},
+		{
+			name: "ld.so.conf includes",
+			objects: map[string]object{
+				"/bin/app":           {interp: glibcLoader, needed: []string{"libfoo.so", "libbar.so"}},
+				"/opt/foo/libfoo.so": lib,
+				"/opt/bar/libbar.so": lib,
+				"/usr/lib/libfoo.so": lib,
+			},
+			files: map[string]string{
+				"/etc/ld.so.conf":            "include ld.so.conf.d/*.conf\n",
+				"/etc/ld.so.conf.d/foo.conf": "# foo\n/opt/foo\ninclude /etc/ld.so.conf\n",
+				"/etc/ld.so.conf.d/bar.conf": "/opt/bar\n",
+			},
+			want:    []string{"/opt/foo/libfoo.so", "/opt/bar/libbar.so"},
+			notWant: []string{"/usr/lib/libfoo.so"},
+		},
+		{
+			name: "musl defaults",
+			objects: map[string]object{
+				"/bin/app":                 {interp: muslLoader, needed: []string{"libfoo.so"}},
+				"/usr/local/lib/libfoo.so": lib,
+				"/usr/lib/libfoo.so":       lib,
+				"/opt/foo/libfoo.so":       lib,
+			},
+			// ld.so.conf is glibc only
+			files:   map[string]string{"/etc/ld.so.conf": "/opt/foo\n"},
+			want:    []string{muslLoader, "/usr/local/lib/libfoo.so"},
+			notWant: []string{"/opt/foo/libfoo.so", "/usr/lib/libfoo.so"},
+		},
+		{
+			name: "musl path file",
+			objects: map[string]object{
+				"/bin/app":                 {interp: muslLoader, needed: []string{"libfoo.so"}},
+				"/usr/local/lib/libfoo.so": lib,
+				"/opt/foo/libfoo.so":       lib,
+			},
+			files:   map[string]string{"/etc/ld-musl-x86_64.path": "/opt/bar:/opt/foo\n/lib\n"},
+			want:    []string{"/opt/foo/libfoo.so"},
+			notWant: []string{"/usr/local/lib/libfoo.so"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, p := range []string{glibcLoader, muslLoader} {
+				writeELF(t, filepath.Join(root, p), lib)
+			}
+			for p, obj := range tc.objects {
+				writeELF(t, filepath.Join(root, p), obj)
+			}
+			for p, content := range tc.files {
+				full := filepath.Join(root, p)
+				if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+					t.Fatal(err)
+				}
+				var err error
+				if len(content) > 2 && content[:2] == "->" {
+					err = os.Symlink(content[2:], full)
+				} else {
+					err = ioutil.WriteFile(full, []byte(content), 0644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			res, err := rootDependencies(root, []string{"/bin/app"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := map[string]bool{}
+			for _, p := range res {
+				found[p] = true
+			}
+			for _, p := range tc.want {
+				if !found[p] {
+					t.Errorf("expected %s in the dependencies, got %v", p, res)
+				}
+			}
+			for _, p := range tc.notWant {
+				if found[p] {
+					t.Errorf("expected %s not to be in the dependencies, got %v", p, res)
+				}
+			}
+		})
+	}
+}
+
+func TestRootDependenciesMissing(t *testing.T) {
+	root := t.TempDir()
+	writeELF(t, filepath.Join(root, glibcLoader), object{})
+	writeELF(t, filepath.Join(root, "/bin/app"), object{interp: glibcLoader, needed: []string{"libfoo.so"}, runpath: "/opt/foo"})
+
+	if _, err := rootDependencies(root, []string{"/bin/app"}); err == nil {
+		t.Fatal("expected the missing libfoo.so to fail")
+	}
+}